@@ -0,0 +1,161 @@
+package main
+
+// Modbus ASCII framing.  Each frame is a colon, the station, function and
+// data in hex, an LRC check byte, then CR LF.  This is translated to and
+// from RTU frames, so that the rest of the bus handler (and the exchanges
+// it produces) are the same whichever framing is used.
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+const (
+	ASCII_INTER_CHAR_TIMEOUT = 1 * time.Second // max gap within a frame
+	ASCII_MAX_FRAME_CHARS    = 513             // excluding the colon
+)
+
+func validFraming(framing string) error {
+	switch framing {
+	case "rtu", "ascii":
+		return nil
+	}
+	return fmt.Errorf("invalid framing %q (must be rtu or ascii)", framing)
+}
+
+// Longitudinal redundancy check: two's complement of the sum of the bytes
+func ModbusLRC(pkt []byte) byte {
+	var sum byte
+	for _, b := range pkt {
+		sum += b
+	}
+	return -sum
+}
+
+// Encode an RTU frame (including CRC) as an ASCII frame
+func encodeASCII(rtu []byte) []byte {
+	pkt := rtu[:len(rtu)-2]
+	s := ":" + strings.ToUpper(hex.EncodeToString(pkt)) + fmt.Sprintf("%02X", ModbusLRC(pkt)) + "\r\n"
+	return []byte(s)
+}
+
+// Decode the characters between colon and CR LF to an RTU frame.  A frame
+// which fails its LRC check is given a bad CRC, so that it is counted as
+// a CRC failure like any other corrupted frame.
+func decodeASCII(frame []byte) ([]byte, bool) {
+	pkt := make([]byte, hex.DecodedLen(len(frame)))
+	if _, err := hex.Decode(pkt, frame); err != nil || len(pkt) < 3 {
+		return nil, false
+	}
+	lrc := pkt[len(pkt)-1]
+	pkt = pkt[:len(pkt)-1]
+	crc := ModbusCRC(pkt)
+	if ModbusLRC(pkt) != lrc {
+		crc[0] ^= 0xff
+	}
+	return append(pkt, crc...), true
+}
+
+// A port carrying ASCII frames, which reads and writes RTU frames.  Read
+// returns only whole frames, and honours the read timeout.
+type asciiPort struct {
+	Port
+	timeout time.Duration
+	rbuf    []byte
+	frame   []byte    // characters after the colon of a partial frame
+	inFrame bool      // colon seen
+	last    time.Time // when the last character of the partial frame arrived
+	pending []byte    // decoded frames not yet returned
+}
+
+func newASCIIPort(port Port) *asciiPort {
+	return &asciiPort{Port: port, timeout: serial.NoTimeout, rbuf: make([]byte, 256)}
+}
+
+func (p *asciiPort) SetReadTimeout(t time.Duration) error {
+	p.timeout = t
+	return nil
+}
+
+func (p *asciiPort) Read(buf []byte) (int, error) {
+	var deadline time.Time
+	if p.timeout != serial.NoTimeout {
+		deadline = time.Now().Add(p.timeout)
+	}
+	for len(p.pending) == 0 {
+		t := serial.NoTimeout
+		if !deadline.IsZero() {
+			if t = time.Until(deadline); t <= 0 {
+				return 0, nil
+			}
+		}
+		if p.inFrame {
+			gap := ASCII_INTER_CHAR_TIMEOUT - time.Since(p.last)
+			if gap < time.Millisecond {
+				gap = time.Millisecond
+			}
+			if t == serial.NoTimeout || gap < t {
+				t = gap
+			}
+		}
+		if err := p.Port.SetReadTimeout(t); err != nil {
+			return 0, err
+		}
+		n, err := p.Port.Read(p.rbuf)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			if p.inFrame && time.Since(p.last) >= ASCII_INTER_CHAR_TIMEOUT {
+				p.inFrame = false // abandon partial frame
+			}
+			continue
+		}
+		p.feed(p.rbuf[:n])
+	}
+	n := copy(buf, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *asciiPort) feed(data []byte) {
+	p.last = time.Now()
+	for _, c := range data {
+		switch {
+		case c == ':':
+			p.inFrame = true
+			p.frame = p.frame[:0]
+		case !p.inFrame:
+			// noise between frames
+		case c == '\n' && len(p.frame) > 0 && p.frame[len(p.frame)-1] == '\r':
+			p.inFrame = false
+			if rtu, ok := decodeASCII(p.frame[:len(p.frame)-1]); ok {
+				p.pending = append(p.pending, rtu...)
+			}
+		case len(p.frame) >= ASCII_MAX_FRAME_CHARS:
+			p.inFrame = false
+		default:
+			p.frame = append(p.frame, c)
+		}
+	}
+}
+
+// Write a whole RTU frame, including CRC
+func (p *asciiPort) Write(buf []byte) (int, error) {
+	if len(buf) < 4 {
+		return 0, fmt.Errorf("frame too short: % X", buf)
+	}
+	frame := encodeASCII(buf)
+	for len(frame) > 0 {
+		n, err := p.Port.Write(frame)
+		if err != nil {
+			return 0, err
+		}
+		frame = frame[n:]
+	}
+	return len(buf), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestASCIIEncode(t *testing.T) {
+	if got := string(encodeASCII(tHex(t, "010480E80001983E"))); got != ":010480E8000192\r\n" {
+		t.Errorf("Unexpected ASCII frame: %q", got)
+	}
+	rtu, ok := decodeASCII([]byte("0104023105C3"))
+	if !ok || !bytes.Equal(rtu, tHex(t, "01040231056CA3")) {
+		t.Errorf("Unexpected RTU frame: %X", rtu)
+	}
+	// Bad LRC gives a bad CRC
+	rtu, ok = decodeASCII([]byte("0104023105C4"))
+	m := &ModbusExchange{Request: tHex(t, "010480E80001983E"), Function: 4, Count: 1}
+	if !ok || m.ParseResponse(rtu) != 0 || m.Error != ERR_CRC_FAILED {
+		t.Errorf("LRC failure not detected: %X %v", rtu, m.Error)
+	}
+	if _, ok := decodeASCII([]byte("01XX")); ok {
+		t.Errorf("Invalid hex accepted")
+	}
+}
+
+// Frames split across reads, with noise between them and a partial frame
+// abandoned by a new colon
+func TestASCIIPortRead(t *testing.T) {
+	fp := tNewFakePort()
+	defer fp.Close()
+	p := newASCIIPort(fp)
+	fp.play(
+		tStep{0, []byte("xx:0104")},
+		tStep{10 * time.Millisecond, []byte("80E8000192\r")},
+		tStep{10 * time.Millisecond, []byte("\n:0104:0104023105C3\r\n")},
+	)
+	buf := make([]byte, 256)
+	var got []byte
+	for len(got) < 15 {
+		n, err := p.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if exp := tHex(t, "010480E80001983E01040231056CA3"); !bytes.Equal(got, exp) {
+		t.Errorf("Got %X, expected %X", got, exp)
+	}
+
+	p.SetReadTimeout(50 * time.Millisecond)
+	fp.play(tStep{0, []byte(":0104")})
+	if n, err := p.Read(buf); n != 0 || err != nil {
+		t.Errorf("Expected timeout on partial frame, got %d %v", n, err)
+	}
+}
+
+// Exchanges sniffed in ASCII mode decode the same as in RTU mode
+func TestSerialSniffASCII(t *testing.T) {
+	_, fp, sub := tFakeSerial(t, &SerialConfig{Device: "fake", Framing: "ascii"})
+	fp.play(
+		tStep{100 * time.Millisecond, []byte(":010480E8000192\r\n")},
+		tStep{tTurnaround, []byte(":0104023105C3\r\n")},
+	)
+	m := <-sub
+	exp := &ModbusExchange{}
+	exp.ParseRequest(tHex(t, "010480E80001983E"))
+	exp.ParseResponse(tHex(t, "01040231056CA3"))
+	m.RequestStart, m.RequestEnd, m.ResponseStart, m.ResponseEnd = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	exp.Sniffed = true
+	if !reflect.DeepEqual(m, exp) {
+		t.Errorf("Got %+v, expected %+v", m, exp)
+	}
+}
+
+func TestSerialInjectASCII(t *testing.T) {
+	s, fp, _ := tFakeSerial(t, &SerialConfig{Device: "fake", Framing: "ascii"})
+	done := make(chan []byte, 1)
+	go func() {
+		var got []byte
+		for !bytes.HasSuffix(got, []byte("\r\n")) {
+			got = append(got, <-fp.tx...)
+		}
+		done <- got
+		fp.play(tStep{tTurnaround, []byte(":0104023105C3\r\n")})
+	}()
+	m := NewReadRequest(1, 4, 33000, 1)
+	tWaitResponse(t, tInject(t, s, m), 5*time.Second)
+	if got := string(<-done); got != ":010480E8000192\r\n" {
+		t.Errorf("Unexpected transmission: %q", got)
+	}
+	if m.Error != nil || !bytes.Equal(m.Data, []byte{0x31, 0x05}) {
+		t.Errorf("Unexpected exchange: %+v", m)
+	}
+}
+
+func TestSerialFramingInvalid(t *testing.T) {
+	if _, err := NewSerial(&SerialConfig{Device: "fake", Framing: "tcp"}); err == nil {
+		t.Errorf("Invalid framing accepted")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+// A bus is one RS485 link (or a replayed capture of one), together with
+// the components attached to it
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+type BusConfig struct {
+	Name     string          `yaml:"name"`
+	Station  byte            `yaml:"station"`
+	Serial   *SerialConfig   `yaml:"serial"`
+	Replay   *ReplayConfig   `yaml:"replay"`
+	Gateway  *GatewayConfig  `yaml:"gateway"`
+	Poller   *PollerConfig   `yaml:"poller"`
+	Recorder *RecorderConfig `yaml:"recorder"`
+}
+
+type Bus struct {
+	config   *BusConfig
+	serial   *Serial
+	replay   *Replay
+	exporter *SolisExporter
+	recorder *Recorder
+	gateway  *Gateway
+	poller   *Poller
+}
+
+// Create the components of a bus.  If metrics is nil, no exporter is
+// attached.
+func NewBus(config *BusConfig, metrics *MetricsServer) (*Bus, error) {
+	var err error
+	b := &Bus{config: config}
+
+	if config.Serial != nil {
+		b.serial, err = NewSerial(config.Serial)
+		if err != nil {
+			return nil, b.errorf("serial: %s", err)
+		}
+		if config.Serial.Dump {
+			log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+		}
+	}
+
+	if config.Replay != nil {
+		b.replay, err = NewReplay(config.Replay)
+		if err != nil {
+			return nil, b.errorf("replay: %s", err)
+		}
+	}
+
+	var source ModbusSource
+	if b.serial != nil {
+		source = b.serial
+	} else if b.replay != nil {
+		source = b.replay
+	}
+
+	if metrics != nil && source != nil {
+		reg := metrics.Registerer(config.Name)
+		b.exporter, err = NewSolisExporter(&SolisExporterConfig{Station: config.Station}, source.Subscribe("exporter", 5, nil).C, reg)
+		if err != nil {
+			return nil, b.errorf("solis_exporter: %s", err)
+		}
+		if b.serial != nil {
+			b.exporter.Register(b.serial.Collectors()...)
+		}
+	}
+
+	if config.Recorder != nil {
+		if source == nil {
+			return nil, b.errorf("recorder requires serial or replay")
+		}
+		b.recorder, err = NewRecorder(config.Recorder, source.Subscribe("recorder", 100, config.Recorder.Filter).C)
+		if err != nil {
+			return nil, b.errorf("recorder: %s", err)
+		}
+	}
+
+	if config.Gateway != nil {
+		if b.serial == nil {
+			return nil, b.errorf("gateway requires serial")
+		}
+		info := &Filter{Function: 4, From: INVERTER_INFO_BASE, To: INVERTER_INFO_BASE + INVERTER_INFO_COUNT - 1}
+		b.gateway, err = NewGateway(config.Gateway, b.serial.Queue, b.serial.Subscribe("gateway", 5, info).C)
+		if err != nil {
+			return nil, b.errorf("gateway: %s", err)
+		}
+	}
+
+	if config.Poller != nil {
+		if b.serial == nil {
+			return nil, b.errorf("poller requires serial")
+		}
+		b.poller, err = NewPoller(config.Poller, b.serial.Queue, b.serial.Subscribe("poller", 5, nil).C)
+		if err != nil {
+			return nil, b.errorf("poller: %s", err)
+		}
+		if b.exporter != nil {
+			b.exporter.Register(b.poller.Collectors()...)
+		}
+	}
+	return b, nil
+}
+
+func (b *Bus) errorf(format string, a ...any) error {
+	err := fmt.Errorf(format, a...)
+	if b.config.Name == "" {
+		return err
+	}
+	return fmt.Errorf("bus %q: %w", b.config.Name, err)
+}
+
+func (b *Bus) Run() {
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	if b.exporter != nil {
+		run(b.exporter.Run)
+	}
+	if b.recorder != nil {
+		run(b.recorder.Run)
+	}
+	if b.gateway != nil {
+		run(b.gateway.Run)
+	}
+	if b.poller != nil {
+		run(b.poller.Run)
+	}
+	if b.serial != nil {
+		run(b.serial.Run)
+	}
+	if b.replay != nil {
+		run(b.replay.Run)
+	}
+	wg.Wait()
+}
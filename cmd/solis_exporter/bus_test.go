@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func tConfig(t *testing.T, yaml string) (*Config, error) {
+	file := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(file, []byte(yaml), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return ReadConfigFile(file)
+}
+
+func TestBusConfig(t *testing.T) {
+	c, err := tConfig(t, "replay:\n  file: x.log\nsolis_exporter:\n  station: 2\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(c.Buses) != 1 || c.Buses[0].Name != "" || c.Buses[0].Replay == nil || c.Buses[0].Station != 2 {
+		t.Errorf("Unexpected implicit bus: %+v", c.Buses)
+	}
+
+	c, err = tConfig(t, `
+solis_exporter:
+  listen: ':3105'
+buses:
+  - name: house
+    serial:
+      device: /dev/ttyUSB0
+  - name: garage
+    station: 3
+    serial:
+      device: /dev/ttyUSB1
+    poller:
+      interval: 1m
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(c.Buses) != 2 || c.Buses[0].Name != "house" || c.Buses[1].Station != 3 || c.Buses[1].Poller.Station != 3 {
+		t.Errorf("Unexpected buses: %+v", c.Buses)
+	}
+
+	for _, bad := range []string{
+		"serial:\n  device: /dev/ttyUSB0\nbuses:\n  - name: a\n    replay:\n      file: x.log\n",
+		"buses:\n  - replay:\n      file: x.log\n",
+		"buses:\n  - name: a\n    replay:\n      file: x.log\n  - name: a\n    replay:\n      file: y.log\n",
+		"buses:\n  - name: a\n",
+		"buses:\n  - name: a\n    replay:\n      file: x.log\n    serial:\n      device: /dev/ttyUSB0\n",
+		"serial:\n  device: /dev/ttyUSB0\n  listen_only: true\ngateway:\n  listen: ':1502'\n",
+		"buses:\n  - name: a\n    serial:\n      device: /dev/ttyUSB0\n      listen_only: true\n    poller:\n      interval: 1m\n",
+	} {
+		if _, err := tConfig(t, bad); err == nil {
+			t.Errorf("Invalid configuration not detected: %q", bad)
+		}
+	}
+}
+
+func TestBusLabels(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "capture.log")
+	if err := os.WriteFile(file, []byte(testReplayLog), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	metrics := NewMetricsServer(&SolisExporterConfig{})
+	for _, name := range []string{"a", "b"} {
+		b, err := NewBus(&BusConfig{Name: name, Station: 1, Replay: &ReplayConfig{File: file}}, metrics)
+		if err != nil {
+			t.Fatalf("NewBus: %v", err)
+		}
+		go b.Run()
+	}
+	tWaitFor(t, 2*time.Second, func() bool {
+		n, err := testutil.GatherAndCount(metrics.reg, "solis_serial_messages_total")
+		return err == nil && n == 4
+	})
+	tWaitFor(t, 2*time.Second, func() bool {
+		mfs, err := metrics.reg.Gather()
+		if err != nil {
+			t.Fatalf("Gather: %v", err)
+		}
+		found := 0
+		for _, mf := range mfs {
+			if mf.GetName() != "solis_grid_power_active" {
+				continue
+			}
+			for _, m := range mf.Metric {
+				for _, l := range m.Label {
+					if l.GetName() == "bus" && (l.GetValue() == "a" || l.GetValue() == "b") {
+						found++
+					}
+				}
+			}
+		}
+		return found == 2
+	})
+}
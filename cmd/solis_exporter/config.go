@@ -8,8 +8,13 @@ import (
 
 type Config struct {
 	Serial        *SerialConfig        `yaml:"serial"`
+	Replay        *ReplayConfig        `yaml:"replay"`
 	SolisExporter *SolisExporterConfig `yaml:"solis_exporter"`
 	Gateway       *GatewayConfig       `yaml:"gateway"`
+	Poller        *PollerConfig        `yaml:"poller"`
+	Recorder      *RecorderConfig      `yaml:"recorder"`
+	Simulator     *SimulatorConfig     `yaml:"simulator"`
+	Buses         []*BusConfig         `yaml:"buses"`
 }
 
 func ReadConfigFile(filename string) (*Config, error) {
@@ -27,9 +32,65 @@ func ReadConfigFile(filename string) (*Config, error) {
 		return nil, err
 	}
 
-	if config.Serial == nil && config.SolisExporter == nil && config.Gateway == nil {
+	if config.Serial == nil && config.Replay == nil && config.SolisExporter == nil && config.Gateway == nil && config.Simulator == nil && config.Buses == nil {
 		return nil, fmt.Errorf("Empty configuration!")
 	}
+	err = config.setupBuses()
+	if err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
+
+// The top-level serial, replay, gateway, poller and recorder settings
+// describe a single unnamed bus, whose metrics have no "bus" label.
+// Alternatively, a list of named buses may be given.
+func (config *Config) setupBuses() error {
+	legacy := config.Serial != nil || config.Replay != nil || config.Gateway != nil || config.Poller != nil || config.Recorder != nil
+	if legacy && config.Buses != nil {
+		return fmt.Errorf("Cannot use top-level serial, replay, gateway, poller or recorder with buses")
+	}
+	if legacy {
+		bus := &BusConfig{
+			Serial:   config.Serial,
+			Replay:   config.Replay,
+			Gateway:  config.Gateway,
+			Poller:   config.Poller,
+			Recorder: config.Recorder,
+		}
+		config.Buses = []*BusConfig{bus}
+	}
+
+	names := make(map[string]bool)
+	for i, bus := range config.Buses {
+		if bus == nil {
+			return fmt.Errorf("Bus %d: empty configuration", i+1)
+		}
+		if !legacy {
+			if bus.Name == "" {
+				return fmt.Errorf("Bus %d: missing name", i+1)
+			}
+			if names[bus.Name] {
+				return fmt.Errorf("Bus %q: duplicate name", bus.Name)
+			}
+			names[bus.Name] = true
+		}
+		if bus.Station == 0 && config.SolisExporter != nil {
+			bus.Station = config.SolisExporter.Station
+		}
+		if bus.Poller != nil && bus.Poller.Station == 0 {
+			bus.Poller.Station = bus.Station
+		}
+		if bus.Serial != nil && bus.Replay != nil {
+			return fmt.Errorf("Cannot use both serial and replay")
+		}
+		if bus.Serial == nil && bus.Replay == nil && !legacy {
+			return fmt.Errorf("Bus %q: requires serial or replay", bus.Name)
+		}
+		if bus.Serial != nil && bus.Serial.ListenOnly && (bus.Gateway != nil || bus.Poller != nil) {
+			return fmt.Errorf("Cannot use gateway or poller with serial listen_only")
+		}
+	}
+	return nil
+}
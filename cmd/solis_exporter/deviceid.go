@@ -0,0 +1,122 @@
+package main
+
+// Read Device Identification (function 43, MEI type 14), answered by the
+// gateway from product information sniffed on the bus, since the inverter
+// itself doesn't implement it
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	MEI_READ_DEVICE_ID = 0x0E
+	DEVICE_ID_VENDOR   = "Ginlong Solis"
+)
+
+// Object IDs, with basic 0-2, regular 3-0x7F and extended 0x80-0xFF
+const (
+	DEVICE_ID_VENDOR_NAME      = 0x00
+	DEVICE_ID_PRODUCT_CODE     = 0x01
+	DEVICE_ID_REVISION         = 0x02
+	DEVICE_ID_PRODUCT_NAME     = 0x04
+	DEVICE_ID_SERIAL_NUMBER    = 0x80
+	DEVICE_ID_PROTOCOL_VERSION = 0x81
+)
+
+type deviceObject struct {
+	id    byte
+	value string
+}
+
+// Latest product information seen for each station
+type deviceIdentities struct {
+	lock sync.Mutex
+	info map[byte]*inverterInfo
+}
+
+func (d *deviceIdentities) observe(m *ModbusExchange) {
+	if m.Error != nil || m.Exception != 0 || m.Function != 4 {
+		return
+	}
+	if m.Base > INVERTER_INFO_BASE || m.Base+m.Count < INVERTER_INFO_BASE+INVERTER_INFO_COUNT {
+		return
+	}
+	off := int(INVERTER_INFO_BASE-m.Base) * 2
+	if off > len(m.Data) {
+		return
+	}
+	if info, ok := decodeInverterInfo(m.Data[off:]); ok {
+		d.lock.Lock()
+		if d.info == nil {
+			d.info = make(map[byte]*inverterInfo)
+		}
+		d.info[m.Station] = info
+		d.lock.Unlock()
+	}
+}
+
+func (d *deviceIdentities) objects(station byte) []deviceObject {
+	d.lock.Lock()
+	info := d.info[station]
+	d.lock.Unlock()
+	if info == nil {
+		return nil
+	}
+	return []deviceObject{
+		{DEVICE_ID_VENDOR_NAME, DEVICE_ID_VENDOR},
+		{DEVICE_ID_PRODUCT_CODE, info.Model},
+		{DEVICE_ID_REVISION, fmt.Sprintf("DSP %s LCD %s", info.DSPVersion, info.LCDVersion)},
+		{DEVICE_ID_PRODUCT_NAME, "Solis inverter"},
+		{DEVICE_ID_SERIAL_NUMBER, info.Serial},
+		{DEVICE_ID_PROTOCOL_VERSION, info.ProtocolVersion},
+	}
+}
+
+// Build the response PDU (after the station) to a Read Device
+// Identification request PDU
+func (d *deviceIdentities) respond(station byte, pdu []byte) []byte {
+	exception := func(code byte) []byte {
+		return []byte{0x2B | 0x80, code}
+	}
+	if len(pdu) != 4 || pdu[1] != MEI_READ_DEVICE_ID {
+		return exception(1) // illegal function: other MEI types not supported
+	}
+	code, start := pdu[2], pdu[3]
+	var last byte
+	switch code {
+	case 1: // basic, stream access
+		last = 0x02
+	case 2: // regular
+		last = 0x7F
+	case 3, 4: // extended, or one specific object
+		last = 0xFF
+	default:
+		return exception(3)
+	}
+	objects := d.objects(station)
+	if objects == nil {
+		return exception(0x0B) // nothing heard from the inverter yet
+	}
+
+	found := false
+	for _, o := range objects {
+		found = found || o.id == start
+	}
+	if !found {
+		if code == 4 {
+			return exception(2)
+		}
+		start = 0 // stream access restarts at the beginning
+	}
+	resp := []byte{0x2B, MEI_READ_DEVICE_ID, code, 0x83, 0, 0, 0}
+	for _, o := range objects {
+		if o.id < start || o.id > last || (code == 4 && o.id != start) {
+			continue
+		}
+		resp = append(resp, o.id, byte(len(o.value)))
+		resp = append(resp, o.value...)
+		resp[6]++
+	}
+	return resp
+}
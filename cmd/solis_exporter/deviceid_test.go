@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func tDeviceIdentities(t *testing.T) *deviceIdentities {
+	data := make([]byte, 82)
+	copy(data, []byte{0x31, 0x05, 0x00, 0x12, 0x00, 0x34, 0x00, 0x02})
+	copy(data[8:], "1031050221230045")
+	d := &deviceIdentities{}
+	d.observe(&ModbusExchange{Station: 1, Function: 4, Base: 33000, Count: 41, Data: data})
+	// Doesn't cover the serial number
+	d.observe(&ModbusExchange{Station: 2, Function: 4, Base: 33000, Count: 10, Data: data[:20]})
+	return d
+}
+
+// Objects as (id, value) pairs from a response PDU
+func tDeviceObjects(t *testing.T, resp []byte) map[byte]string {
+	if len(resp) < 7 || resp[0] != 0x2B || resp[1] != MEI_READ_DEVICE_ID {
+		t.Fatalf("Unexpected response: % X", resp)
+	}
+	objects := make(map[byte]string)
+	p := resp[7:]
+	for i := 0; i < int(resp[6]); i++ {
+		if len(p) < 2 || len(p) < 2+int(p[1]) {
+			t.Fatalf("Truncated object list: % X", resp)
+		}
+		objects[p[0]] = string(p[2 : 2+p[1]])
+		p = p[2+p[1]:]
+	}
+	if len(p) != 0 {
+		t.Errorf("Trailing data: % X", p)
+	}
+	return objects
+}
+
+func TestDeviceIdentification(t *testing.T) {
+	d := tDeviceIdentities(t)
+
+	objects := tDeviceObjects(t, d.respond(1, []byte{0x2B, 0x0E, 0x01, 0x00}))
+	if len(objects) != 3 || objects[0] != DEVICE_ID_VENDOR || objects[1] != "3105" || objects[2] != "DSP 0012 LCD 0034" {
+		t.Errorf("Unexpected basic objects: %q", objects)
+	}
+	objects = tDeviceObjects(t, d.respond(1, []byte{0x2B, 0x0E, 0x03, 0x00}))
+	if len(objects) != 6 || objects[DEVICE_ID_SERIAL_NUMBER] != "1031050221230045" || objects[DEVICE_ID_PROTOCOL_VERSION] != "0002" {
+		t.Errorf("Unexpected extended objects: %q", objects)
+	}
+	objects = tDeviceObjects(t, d.respond(1, []byte{0x2B, 0x0E, 0x04, 0x80}))
+	if len(objects) != 1 || objects[DEVICE_ID_SERIAL_NUMBER] != "1031050221230045" {
+		t.Errorf("Unexpected individual object: %q", objects)
+	}
+	// Unknown start object: stream access starts from the beginning
+	objects = tDeviceObjects(t, d.respond(1, []byte{0x2B, 0x0E, 0x02, 0x33}))
+	if len(objects) != 4 {
+		t.Errorf("Unexpected regular objects: %q", objects)
+	}
+
+	for _, c := range []struct {
+		station byte
+		pdu     []byte
+		exp     []byte
+	}{
+		{1, []byte{0x2B, 0x0E, 0x04, 0x33}, []byte{0xAB, 0x02}},
+		{1, []byte{0x2B, 0x0E, 0x05, 0x00}, []byte{0xAB, 0x03}},
+		{1, []byte{0x2B, 0x0D, 0x01, 0x00}, []byte{0xAB, 0x01}},
+		{2, []byte{0x2B, 0x0E, 0x01, 0x00}, []byte{0xAB, 0x0B}},
+	} {
+		if got := d.respond(c.station, c.pdu); !bytes.Equal(got, c.exp) {
+			t.Errorf("% X: got % X, expected % X", c.pdu, got, c.exp)
+		}
+	}
+}
+
+// The gateway answers without touching the bus
+func TestGatewayDeviceIdentification(t *testing.T) {
+	g := &Gateway{config: &GatewayConfig{Rules: []Rule{{From: 33000, To: 33999}}}}
+	g.ident.info = tDeviceIdentities(t).info
+	client, server := net.Pipe()
+	defer client.Close()
+	go g.handleConnection(server)
+
+	// Nothing is returned for broadcast, nor to a station the rules
+	// don't allow
+	client.Write(tMBAP(1, tHex(t, "002B0E0401")))
+	if resp := tGatewayRequest(t, client, 2, tHex(t, "022B0E0401")); !bytes.Equal(resp, tHex(t, "02AB02")) {
+		t.Errorf("Expected exception for station 2, got % X", resp)
+	}
+
+	client.Write([]byte{0x12, 0x34, 0x00, 0x00, 0x00, 0x05, 0x01, 0x2B, 0x0E, 0x04, 0x01})
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(client, header); err != nil {
+		t.Fatalf("Read header: %v", err)
+	}
+	if header[0] != 0x12 || header[1] != 0x34 {
+		t.Errorf("Transaction ID not returned: % X", header)
+	}
+	resp := make([]byte, int(header[4])<<8|int(header[5]))
+	if _, err := io.ReadFull(client, resp); err != nil {
+		t.Fatalf("Read response: %v", err)
+	}
+	if resp[0] != 0x01 {
+		t.Errorf("Unexpected station: % X", resp)
+	}
+	if objects := tDeviceObjects(t, resp[1:]); objects[1] != "3105" {
+		t.Errorf("Unexpected objects: %q", objects)
+	}
+}
@@ -13,6 +13,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
@@ -164,28 +166,70 @@ var gaugeVecS16 = scaledGaugeVecS16(1.0)
 var gaugeVecU32 = scaledGaugeVecU32(1.0)
 var gaugeVecS32 = scaledGaugeVecS32(1.0)
 
-// The overall exporter instance
+// The HTTP listener and registry shared by the exporters for all buses
+type MetricsServer struct {
+	config *SolisExporterConfig
+	reg    *prometheus.Registry
+}
+
+// The exporter instance for one bus
 type SolisExporter struct {
 	config      *SolisExporterConfig
 	modbus      <-chan *ModbusExchange
-	reg         *prometheus.Registry
+	reg         prometheus.Registerer
 	metrics     map[uint16]ModbusMetricHandler
 	messages    *prometheus.CounterVec
 	errors      *prometheus.CounterVec
 	lastMessage prometheus.Gauge
+	latency     *prometheus.HistogramVec
+	frameTime   *prometheus.HistogramVec
+	idleGap     *prometheus.HistogramVec
+	lastEnd     time.Time // end of the previous exchange on the bus
 }
 
-func NewSolisExporter(config *SolisExporterConfig, modbus <-chan *ModbusExchange) (*SolisExporter, error) {
+func NewMetricsServer(config *SolisExporterConfig) *MetricsServer {
 	if config.Listen == "" {
 		config.Listen = ":3105"
 	}
+	s := &MetricsServer{
+		config: config,
+		reg:    prometheus.NewRegistry(),
+	}
+
+	// Register system metrics
+	s.reg.MustRegister(collectors.NewBuildInfoCollector())
+	if s.config.GoCollector {
+		s.reg.MustRegister(collectors.NewGoCollector())
+	}
+	if s.config.ProcessCollector {
+		s.reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+	return s
+}
+
+// Where to register the metrics for a bus.  Metrics of named buses
+// carry a "bus" label.
+func (s *MetricsServer) Registerer(bus string) prometheus.Registerer {
+	if bus == "" {
+		return s.reg
+	}
+	return prometheus.WrapRegistererWith(prometheus.Labels{"bus": bus}, s.reg)
+}
+
+func (s *MetricsServer) Run() {
+	http.Handle("/metrics", promhttp.HandlerFor(s.reg, promhttp.HandlerOpts{Registry: s.reg}))
+	log.Printf("Starting metrics listener on %s", s.config.Listen)
+	log.Fatal(http.ListenAndServe(s.config.Listen, nil))
+}
+
+func NewSolisExporter(config *SolisExporterConfig, modbus <-chan *ModbusExchange, reg prometheus.Registerer) (*SolisExporter, error) {
 	if config.Station == 0 {
 		config.Station = 1
 	}
 	e := &SolisExporter{
 		config:  config,
 		modbus:  modbus,
-		reg:     prometheus.NewRegistry(),
+		reg:     reg,
 		metrics: make(map[uint16]ModbusMetricHandler),
 		messages: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
@@ -203,10 +247,34 @@ func NewSolisExporter(config *SolisExporterConfig, modbus <-chan *ModbusExchange
 			Name: "solis_serial_last_message_time_seconds",
 			Help: "Time when last message received, in unixtime",
 		}),
+		latency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "solis_serial_response_latency_seconds",
+				Help:    "Time from end of request to start of response",
+				Buckets: []float64{0.005, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1, 2},
+			},
+			[]string{"source", "function"}),
+		frameTime: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "solis_serial_frame_duration_seconds",
+				Help:    "Time from first to last byte of a request or response",
+				Buckets: []float64{0.005, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1},
+			},
+			[]string{"source", "function", "frame"}),
+		idleGap: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "solis_serial_idle_gap_seconds",
+				Help:    "Time the bus was idle before a request",
+				Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10, 30, 60},
+			},
+			[]string{"source", "function"}),
 	}
 	e.reg.MustRegister(e.messages)
 	e.reg.MustRegister(e.errors)
 	e.reg.MustRegister(e.lastMessage)
+	e.reg.MustRegister(e.latency)
+	e.reg.MustRegister(e.frameTime)
+	e.reg.MustRegister(e.idleGap)
 	// Instantiate the counters to zero
 	for _, label := range []string{"sniffed", "injected"} {
 		e.messages.WithLabelValues(label)
@@ -215,20 +283,16 @@ func NewSolisExporter(config *SolisExporterConfig, modbus <-chan *ModbusExchange
 		e.errors.WithLabelValues(label)
 	}
 
-	// Register system metrics
-	e.reg.MustRegister(collectors.NewBuildInfoCollector())
-	if e.config.GoCollector {
-		e.reg.MustRegister(collectors.NewGoCollector())
-	}
-	if e.config.ProcessCollector {
-		e.reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
-	}
-
 	// Register inverter metrics parsed from modbus messages
 	e.addSolisMetrics()
 	return e, nil
 }
 
+// Register additional collectors, such as those of the serial port handler
+func (e *SolisExporter) Register(cs ...prometheus.Collector) {
+	e.reg.MustRegister(cs...)
+}
+
 func (e *SolisExporter) addHandler(regbase uint16, handler ModbusMetricHandler) {
 	if _, ok := e.metrics[regbase]; ok {
 		log.Fatalf("Duplicate metric registration: %d", regbase)
@@ -237,6 +301,33 @@ func (e *SolisExporter) addHandler(regbase uint16, handler ModbusMetricHandler)
 	handler.SetRegistry(e.reg)
 }
 
+// Product information, from registers 33000-33019
+const (
+	INVERTER_INFO_BASE  = 33000
+	INVERTER_INFO_COUNT = 20
+)
+
+type inverterInfo struct {
+	Model           string
+	DSPVersion      string
+	LCDVersion      string
+	ProtocolVersion string
+	Serial          string
+}
+
+func decodeInverterInfo(data []byte) (*inverterInfo, bool) {
+	if len(data) < INVERTER_INFO_COUNT*2 {
+		return nil, false
+	}
+	return &inverterInfo{
+		Model:           fmt.Sprintf("%04X", data[0:2]),
+		DSPVersion:      fmt.Sprintf("%04X", data[2:4]),
+		LCDVersion:      fmt.Sprintf("%04X", data[4:6]),
+		ProtocolVersion: fmt.Sprintf("%04X", data[6:8]),
+		Serial:          string(bytes.TrimRight(data[8:40], "\x00")),
+	}, true
+}
+
 func (e *SolisExporter) addSolisMetrics() {
 	// Read register 33000-33040: Product information and total power generation
 	e.addHandler(33000, &handlerGaugeVec{
@@ -247,15 +338,9 @@ func (e *SolisExporter) addSolisMetrics() {
 			},
 			[]string{"model", "dsp_version", "lcd_version", "protocol_version", "serial"}),
 		f: func(gv *prometheus.GaugeVec, data []byte) {
-			if len(data) >= 40 {
+			if info, ok := decodeInverterInfo(data); ok {
 				gv.Reset()
-				gv.WithLabelValues(
-					fmt.Sprintf("%04X", data[0:2]),
-					fmt.Sprintf("%04X", data[2:4]),
-					fmt.Sprintf("%04X", data[4:6]),
-					fmt.Sprintf("%04X", data[6:8]),
-					string(bytes.TrimRight(data[8:40], "\x00")),
-				).Set(1)
+				gv.WithLabelValues(info.Model, info.DSPVersion, info.LCDVersion, info.ProtocolVersion, info.Serial).Set(1)
 			}
 		},
 	})
@@ -636,6 +721,33 @@ func (e *SolisExporter) addSolisMetrics() {
 	})
 }
 
+// Record bus timings, where the source of the exchange provides them
+func (e *SolisExporter) observeTiming(m *ModbusExchange) {
+	source := "injected"
+	if m.Sniffed {
+		source = "sniffed"
+	}
+	function := strconv.Itoa(int(m.Function))
+	since := func(t0, t1 time.Time) float64 {
+		return t1.Sub(t0).Seconds()
+	}
+
+	if !m.RequestStart.IsZero() && !e.lastEnd.IsZero() && m.RequestStart.After(e.lastEnd) {
+		e.idleGap.WithLabelValues(source, function).Observe(since(e.lastEnd, m.RequestStart))
+	}
+	if m.RequestStart.IsZero() || m.RequestEnd.IsZero() {
+		return
+	}
+	e.frameTime.WithLabelValues(source, function, "request").Observe(since(m.RequestStart, m.RequestEnd))
+	e.lastEnd = m.RequestEnd
+	if m.ResponseStart.IsZero() || m.ResponseEnd.IsZero() {
+		return
+	}
+	e.latency.WithLabelValues(source, function).Observe(since(m.RequestEnd, m.ResponseStart))
+	e.frameTime.WithLabelValues(source, function, "response").Observe(since(m.ResponseStart, m.ResponseEnd))
+	e.lastEnd = m.ResponseEnd
+}
+
 func (e *SolisExporter) handleMessage(m *ModbusExchange) {
 	if m.Sniffed {
 		e.messages.WithLabelValues("sniffed").Inc()
@@ -651,6 +763,7 @@ func (e *SolisExporter) handleMessage(m *ModbusExchange) {
 		return
 	}
 	e.lastMessage.SetToCurrentTime()
+	e.observeTiming(m)
 	if m.Exception != 0 {
 		return
 	}
@@ -659,7 +772,7 @@ func (e *SolisExporter) handleMessage(m *ModbusExchange) {
 	}
 
 	switch m.Function {
-	case 3, 4: // multi-register read: 'Count' is the number of (2-byte) registers in 'Data'
+	case 3, 4, 23: // multi-register read: 'Count' is the number of (2-byte) registers in 'Data'
 		limit := m.Base + m.Count
 		for r := m.Base; r < limit; r++ {
 			if handler, ok := e.metrics[r]; ok {
@@ -674,13 +787,7 @@ func (e *SolisExporter) handleMessage(m *ModbusExchange) {
 }
 
 func (e *SolisExporter) Run() {
-	go func() {
-		for m := range e.modbus {
-			e.handleMessage(m)
-		}
-	}()
-
-	http.Handle("/metrics", promhttp.HandlerFor(e.reg, promhttp.HandlerOpts{Registry: e.reg}))
-	log.Printf("Starting metrics listener on %s", e.config.Listen)
-	log.Fatal(http.ListenAndServe(e.config.Listen, nil))
+	for m := range e.modbus {
+		e.handleMessage(m)
+	}
 }
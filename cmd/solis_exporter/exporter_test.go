@@ -4,14 +4,17 @@ import (
 	"encoding/hex"
 	"math"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 const float64EqualityThreshold = 0.00001
 
 func tExporter(t *testing.T) *SolisExporter {
-	e, err := NewSolisExporter(&SolisExporterConfig{}, nil)
+	e, err := NewSolisExporter(&SolisExporterConfig{}, nil, prometheus.NewRegistry())
 	if err != nil {
 		t.Fatalf("Failed to create exporter: %v", err)
 	}
@@ -126,3 +129,40 @@ func TestExporterPoll33250(t *testing.T) {
 	m := tPrepExchange(t, "0103A8010001F5AA", "01030200017984")
 	e.handleMessage(m)
 }
+
+func TestExporterTiming(t *testing.T) {
+	e := tExporter(t)
+	t0 := time.Now()
+	m := tPrepExchange(t, "010480E80001983E", "01040231056CA3")
+	m.Sniffed = true
+	m.RequestStart = t0
+	m.RequestEnd = t0.Add(8 * time.Millisecond)
+	m.ResponseStart = t0.Add(58 * time.Millisecond)
+	m.ResponseEnd = t0.Add(65 * time.Millisecond)
+	e.handleMessage(m)
+
+	m = tPrepExchange(t, "010480E80001983E", "01040231056CA3")
+	m.RequestStart = t0.Add(1065 * time.Millisecond)
+	m.RequestEnd = t0.Add(1073 * time.Millisecond)
+	e.handleMessage(m) // no response timestamps, e.g. replayed
+
+	for _, c := range []struct {
+		h     prometheus.Observer
+		count uint64
+		sum   float64
+	}{
+		{e.latency.WithLabelValues("sniffed", "4"), 1, 0.050},
+		{e.frameTime.WithLabelValues("sniffed", "4", "request"), 1, 0.008},
+		{e.frameTime.WithLabelValues("sniffed", "4", "response"), 1, 0.007},
+		{e.frameTime.WithLabelValues("injected", "4", "request"), 1, 0.008},
+		{e.latency.WithLabelValues("injected", "4"), 0, 0},
+		{e.idleGap.WithLabelValues("injected", "4"), 1, 1.0},
+	} {
+		pb := &dto.Metric{}
+		c.h.(prometheus.Metric).Write(pb)
+		h := pb.GetHistogram()
+		if h.GetSampleCount() != c.count || math.Abs(h.GetSampleSum()-c.sum) > 1e-9 {
+			t.Errorf("%s: got %d/%v, expected %d/%v", c.h.(prometheus.Metric).Desc(), h.GetSampleCount(), h.GetSampleSum(), c.count, c.sum)
+		}
+	}
+}
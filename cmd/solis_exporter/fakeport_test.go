@@ -0,0 +1,554 @@
+package main
+
+// In-memory port, so that the bus state machine can be tested without a
+// pty and with controlled timing
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.bug.st/serial"
+)
+
+type tFakePort struct {
+	rx      chan []byte // chunks to be returned by Read
+	tx      chan []byte // chunks passed to Write
+	pending []byte
+	timeout time.Duration
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// Bytes arriving after a delay from the previous step
+type tStep struct {
+	after time.Duration
+	data  []byte
+}
+
+func tNewFakePort() *tFakePort {
+	return &tFakePort{
+		rx:      make(chan []byte, 16),
+		tx:      make(chan []byte, 16),
+		timeout: serial.NoTimeout,
+		closed:  make(chan struct{}),
+	}
+}
+
+func (p *tFakePort) Read(buf []byte) (int, error) {
+	if len(p.pending) == 0 {
+		var timer <-chan time.Time
+		if p.timeout != serial.NoTimeout {
+			timer = time.After(p.timeout)
+		}
+		select {
+		case p.pending = <-p.rx:
+		case <-timer:
+			return 0, nil
+		case <-p.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(buf, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *tFakePort) Write(buf []byte) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, io.ErrClosedPipe
+	case p.tx <- append([]byte(nil), buf...):
+		return len(buf), nil
+	}
+}
+
+func (p *tFakePort) SetReadTimeout(t time.Duration) error {
+	p.timeout = t
+	return nil
+}
+
+func (p *tFakePort) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+// Deliver bytes to the reader according to a script
+func (p *tFakePort) play(steps ...tStep) {
+	go func() {
+		for _, step := range steps {
+			time.Sleep(step.after)
+			select {
+			case p.rx <- step.data:
+			case <-p.closed:
+				return
+			}
+		}
+	}()
+}
+
+// Act as a device which answers the next request after a delay.  Returns
+// when the request was written.
+func (p *tFakePort) respond(delay time.Duration, rep []byte) <-chan time.Time {
+	written := make(chan time.Time, 1)
+	go func() {
+		select {
+		case <-p.tx:
+		case <-p.closed:
+			return
+		}
+		written <- time.Now()
+		if rep != nil {
+			p.play(tStep{delay, rep})
+		}
+	}()
+	return written
+}
+
+// A running serial handler on a fake port
+func tFakeSerial(t *testing.T, config *SerialConfig) (*Serial, *tFakePort, <-chan *ModbusExchange) {
+	fp := tNewFakePort()
+	t.Cleanup(func() { fp.Close() })
+	opened := false
+	s, err := newSerial(config, func() (Port, error) {
+		if opened {
+			return nil, io.ErrClosedPipe
+		}
+		opened = true
+		return fp, nil
+	})
+	if err != nil {
+		t.Fatalf("newSerial: %v", err)
+	}
+	sub := s.Subscribe("test", 5, nil).C
+	go s.Run()
+	return s, fp, sub
+}
+
+func tInject(t *testing.T, s *Serial, m *ModbusExchange) <-chan struct{} {
+	responseChan := make(chan struct{}, 1)
+	if err := s.Queue.Submit(&InjectMessage{Modbus: m, ResponseChan: responseChan, Source: "test"}); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	return responseChan
+}
+
+func tWaitResponse(t *testing.T, responseChan <-chan struct{}, timeout time.Duration) {
+	t.Helper()
+	select {
+	case <-responseChan:
+	case <-time.After(timeout):
+		t.Fatalf("No response within %v", timeout)
+	}
+}
+
+// The next exchange published to a subscription
+func tReceive(t *testing.T, sub <-chan *ModbusExchange, timeout time.Duration) *ModbusExchange {
+	t.Helper()
+	select {
+	case m := <-sub:
+		return m
+	case <-time.After(timeout):
+		t.Fatalf("Nothing published within %v", timeout)
+		return nil
+	}
+}
+
+// The time a request was written, as returned by respond
+func tWritten(t *testing.T, written <-chan time.Time, timeout time.Duration) time.Time {
+	t.Helper()
+	select {
+	case w := <-written:
+		return w
+	case <-time.After(timeout):
+		t.Fatalf("Nothing written within %v", timeout)
+		return time.Time{}
+	}
+}
+
+// A device's response is not sent until the request has been received,
+// which at 9600 baud takes about 1ms per byte
+const tTurnaround = 20 * time.Millisecond
+
+func TestSerialSniff(t *testing.T) {
+	_, fp, sub := tFakeSerial(t, &SerialConfig{Device: "fake"})
+	bcast := tHex(t, "0006A80A0001")
+	bcast = append(bcast, ModbusCRC(bcast)...)
+	fp.play(
+		tStep{100 * time.Millisecond, tHex(t, "010480E80001983E")},
+		tStep{tTurnaround, tHex(t, "01040231056CA3")},
+		tStep{500 * time.Millisecond, bcast},
+	)
+
+	m := tReceive(t, sub, 2*time.Second)
+	if m.Error != nil || !m.Sniffed || m.Base != 33000 || !bytes.Equal(m.Data, []byte{0x31, 0x05}) {
+		t.Errorf("Unexpected exchange: %+v", m)
+	}
+	if !m.RequestEnd.After(m.RequestStart) || m.ResponseStart.Before(m.RequestEnd) || m.ResponseEnd.Before(m.ResponseStart) {
+		t.Errorf("Timestamps out of order: %+v", m)
+	}
+	m = tReceive(t, sub, 2*time.Second)
+	if m.Error != nil || !m.Sniffed || m.Station != 0 || m.Base != 43018 || m.Response != nil {
+		t.Errorf("Unexpected broadcast: %+v", m)
+	}
+}
+
+// An injected request must wait until the line has been idle for
+// BUSY_TIMEOUT after the last sniffed exchange
+func TestSerialInjectIdle(t *testing.T) {
+	s, fp, sub := tFakeSerial(t, &SerialConfig{Device: "fake"})
+	fp.play(
+		tStep{100 * time.Millisecond, tHex(t, "010480E80001983E")},
+		tStep{tTurnaround, tHex(t, "01040231056CA3")},
+	)
+	tReceive(t, sub, 2*time.Second)
+	sniffed := time.Now()
+
+	rep := tHex(t, "0104023333")
+	rep = append(rep, ModbusCRC(rep)...)
+	written := fp.respond(tTurnaround, rep)
+	m := NewReadRequest(1, 4, 33000, 1)
+	responseChan := tInject(t, s, m)
+	tWaitResponse(t, responseChan, 5*time.Second)
+	if d := tWritten(t, written, time.Second).Sub(sniffed); d < BUSY_TIMEOUT-10*time.Millisecond {
+		t.Errorf("Injected only %v after sniffed exchange", d)
+	}
+	if m.Error != nil || m.Sniffed || !bytes.Equal(m.Response, rep) {
+		t.Errorf("Unexpected exchange: %+v", m)
+	}
+	if pub := tReceive(t, sub, time.Second); pub != m {
+		t.Errorf("Injected exchange not published: %+v", pub)
+	}
+}
+
+// After a timeout the line must become available again
+func TestSerialInjectTimeout(t *testing.T) {
+	s, fp, _ := tFakeSerial(t, &SerialConfig{Device: "fake", Retry: RetryConfig{MaxAttempts: 1}})
+	written := fp.respond(0, nil)
+	m := NewReadRequest(1, 4, 33000, 1)
+	responseChan := tInject(t, s, m)
+	tWaitResponse(t, responseChan, 2*BUSY_TIMEOUT+s.exchangeTimeout(m))
+	if d := time.Since(tWritten(t, written, time.Second)); d < RESPONSE_TIMEOUT {
+		t.Errorf("Timed out after only %v", d)
+	}
+	if m.Error != ERR_TIMEOUT {
+		t.Errorf("Expected timeout, got %+v", m)
+	}
+
+	rep := tHex(t, "01040231056CA3")
+	fp.respond(tTurnaround, rep)
+	m = NewReadRequest(1, 4, 33000, 1)
+	tWaitResponse(t, tInject(t, s, m), 2*BUSY_TIMEOUT+s.exchangeTimeout(m))
+	if m.Error != nil || !bytes.Equal(m.Response, rep) {
+		t.Errorf("Unexpected exchange after timeout: %+v", m)
+	}
+	if v := testutil.ToFloat64(s.retry.results.WithLabelValues("test", "timeout")); v != 1 {
+		t.Errorf("Expected 1 timeout result, got %v", v)
+	}
+}
+
+// No response is expected to a broadcast, but the line must be left
+// quiet afterwards for the devices to act on it
+func TestSerialInjectBroadcast(t *testing.T) {
+	s, fp, _ := tFakeSerial(t, &SerialConfig{Device: "fake"})
+	written := fp.respond(0, nil)
+	bcast := &ModbusExchange{}
+	req := tHex(t, "0006A80A0001")
+	bcast.ParseRequest(append(req, ModbusCRC(req)...))
+	tWaitResponse(t, tInject(t, s, bcast), 5*time.Second)
+	sent := tWritten(t, written, time.Second)
+	if d := time.Since(sent); d > RESPONSE_TIMEOUT/2 {
+		t.Errorf("Broadcast waited %v for a response", d)
+	}
+	if bcast.Error != nil {
+		t.Errorf("Unexpected error: %v", bcast.Error)
+	}
+
+	written = fp.respond(tTurnaround, tHex(t, "01040231056CA3"))
+	m := NewReadRequest(1, 4, 33000, 1)
+	tWaitResponse(t, tInject(t, s, m), 5*time.Second)
+	if d := tWritten(t, written, time.Second).Sub(sent); d < POST_BROADCAST_TIMEOUT {
+		t.Errorf("Next request sent only %v after broadcast", d)
+	}
+}
+
+// Holds each write until released, once the sender has handed the
+// exchange over to the reader
+type tGatedWritePort struct {
+	*tFakePort
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (p tGatedWritePort) Write(buf []byte) (int, error) {
+	select {
+	case p.writing <- struct{}{}:
+	default:
+	}
+	<-p.release
+	return p.tFakePort.Write(buf)
+}
+
+// Another master starts a request while ours is being sent: the reader
+// takes its first byte as the start of our response, and must report a
+// collision rather than a response, and the sniffed exchange is still
+// recovered.  The request is then sent again.
+func TestSerialInjectCollision(t *testing.T) {
+	fp := tNewFakePort()
+	defer fp.Close()
+	gp := tGatedWritePort{fp, make(chan struct{}, 1), make(chan struct{})}
+	s, err := newSerial(&SerialConfig{Device: "fake", Retry: RetryConfig{Backoff: time.Millisecond}}, func() (Port, error) { return gp, nil })
+	if err != nil {
+		t.Fatalf("newSerial: %v", err)
+	}
+	sub := s.Subscribe("test", 5, nil).C
+	go s.Run()
+
+	m := NewReadRequest(1, 4, 33000, 1)
+	timeout := 2*BUSY_TIMEOUT + 3*s.exchangeTimeout(m)
+	responseChan := tInject(t, s, m)
+	select {
+	case <-gp.writing:
+	case <-time.After(2 * BUSY_TIMEOUT):
+		t.Fatalf("Request not sent")
+	}
+	req := tHex(t, "0103A8610001")
+	req = append(req, ModbusCRC(req)...)
+	other := tHex(t, "0103020005")
+	other = append(other, ModbusCRC(other)...)
+	fp.play(tStep{0, req}, tStep{tTurnaround, other})
+	time.Sleep(tTurnaround / 2)
+	close(gp.release)
+	<-fp.tx
+
+	rep := tHex(t, "01040231056CA3")
+	written := fp.respond(tTurnaround, rep)
+	tWaitResponse(t, responseChan, timeout)
+	if m.Error != nil || !bytes.Equal(m.Response, rep) {
+		t.Errorf("Unexpected exchange after collision: %+v", m)
+	}
+	tWritten(t, written, time.Second)
+
+	var collided, sniffed bool
+	for !collided || !sniffed {
+		pub := tReceive(t, sub, time.Second)
+		switch {
+		case pub.Sniffed:
+			if pub.Error != nil || pub.Function != 3 || pub.Base != 43105 || !bytes.Equal(pub.Response, other) {
+				t.Errorf("Unexpected sniffed exchange: %+v", pub)
+			}
+			sniffed = true
+		case pub == m:
+			t.Fatalf("Published before the collision: %+v", pub)
+		default:
+			if pub.Error != ERR_COLLISION {
+				t.Errorf("Expected collision, got %+v", pub)
+			}
+			collided = true
+		}
+	}
+	if v := testutil.ToFloat64(s.retry.attempts.WithLabelValues("test")); v != 2 {
+		t.Errorf("Expected 2 attempts, got %v", v)
+	}
+}
+
+// The reader has claimed the line for a sniffed request when we decide
+// to transmit
+func TestSerialTransmitLineClaimed(t *testing.T) {
+	fp := tNewFakePort()
+	defer fp.Close()
+	s, err := newSerial(&SerialConfig{Device: "fake"}, func() (Port, error) { return fp, nil })
+	if err != nil {
+		t.Fatalf("newSerial: %v", err)
+	}
+	sub := s.Subscribe("test", 5, nil).C
+	s.msg.Store(&ModbusExchange{Sniffed: true})
+
+	m := NewReadRequest(1, 4, 33000, 1)
+	i := &InjectMessage{Modbus: m, ResponseChan: make(chan struct{}, 1)}
+	response := make(chan struct{}, 1)
+	if _, ok, again := s.transmit(i, response); ok || !again || i.attempts != 1 {
+		t.Errorf("Expected resend after collision: ok=%v again=%v attempts=%d", ok, again, i.attempts)
+	}
+	if pub := tReceive(t, sub, time.Second); pub.Error != ERR_COLLISION {
+		t.Errorf("Expected collision to be published, got %+v", pub)
+	}
+
+	i.attempts = RETRY_MAX_ATTEMPTS - 1
+	if _, ok, again := s.transmit(i, response); ok || again {
+		t.Errorf("Expected failure: ok=%v again=%v", ok, again)
+	}
+	select {
+	case <-i.ResponseChan:
+	default:
+		t.Errorf("Requester not told of failure")
+	}
+	if m.Error != ERR_COLLISION {
+		t.Errorf("Expected collision, got %v", m.Error)
+	}
+	if len(fp.tx) != 0 {
+		t.Errorf("Request transmitted during collision")
+	}
+}
+
+// A response which completes as the sender times out must not be
+// reported as a timeout
+func TestSerialReclaim(t *testing.T) {
+	s, err := newSerial(&SerialConfig{Device: "fake"}, func() (Port, error) { return tNewFakePort(), nil })
+	if err != nil {
+		t.Fatalf("newSerial: %v", err)
+	}
+	m := NewReadRequest(1, 4, 33000, 1)
+	response := make(chan struct{}, 1)
+
+	// Not claimed by the reader
+	s.msg.Store(m)
+	if !s.reclaim(m, response) || s.msg.Load() != nil {
+		t.Errorf("Unclaimed exchange not taken back")
+	}
+
+	// Claimed, and finished just now
+	s.msg.Store(nil)
+	response <- struct{}{}
+	if s.reclaim(m, response) {
+		t.Errorf("Completed exchange reported as timed out")
+	}
+
+	// Claimed, and still being received
+	s.msg.Store(s.receiving)
+	go func() {
+		time.Sleep(tTurnaround)
+		response <- struct{}{}
+		s.msg.CompareAndSwap(s.receiving, nil)
+	}()
+	if s.reclaim(m, response) {
+		t.Errorf("Exchange being received reported as timed out")
+	}
+
+	// Taken back by the reader after losing sync, without being claimed
+	s.msg.Store(&ModbusExchange{Sniffed: true})
+	if !s.reclaim(m, response) {
+		t.Errorf("Unclaimed exchange not reported as timed out")
+	}
+}
+
+// The response starts just before the deadline and ends after it
+func TestSerialInjectLateResponse(t *testing.T) {
+	s, fp, _ := tFakeSerial(t, &SerialConfig{Device: "fake", Retry: RetryConfig{MaxAttempts: 2, Backoff: time.Millisecond}})
+	m := NewReadRequest(1, 4, 33000, 1)
+	rep := tHex(t, "01040231056CA3")
+	go func() {
+		<-fp.tx
+		gap := s.interByteTimeout / 2
+		fp.play(tStep{s.exchangeTimeout(m) - gap/2, rep[:1]}, tStep{gap, rep[1:]})
+	}()
+	tWaitResponse(t, tInject(t, s, m), 2*BUSY_TIMEOUT+s.exchangeTimeout(m))
+	if m.Error != nil || !bytes.Equal(m.Response, rep) {
+		t.Errorf("Unexpected exchange: %+v", m)
+	}
+	if v := testutil.ToFloat64(s.retry.attempts.WithLabelValues("test")); v != 1 {
+		t.Errorf("Expected 1 attempt, got %v", v)
+	}
+}
+
+type tBrokenWritePort struct {
+	*tFakePort
+}
+
+func (p tBrokenWritePort) Write(buf []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+// A failed write fails the request at once, rather than waiting for a
+// response which can't arrive
+func TestSerialInjectWriteError(t *testing.T) {
+	fp := tNewFakePort()
+	defer fp.Close()
+	s, err := newSerial(&SerialConfig{Device: "fake"}, func() (Port, error) { return tBrokenWritePort{fp}, nil })
+	if err != nil {
+		t.Fatalf("newSerial: %v", err)
+	}
+	go s.Run()
+	m := NewReadRequest(1, 4, 33000, 1)
+	responseChan := tInject(t, s, m)
+	start := time.Now()
+	tWaitResponse(t, responseChan, 2*BUSY_TIMEOUT+s.exchangeTimeout(m))
+	if d := time.Since(start); d > BUSY_TIMEOUT+RESPONSE_TIMEOUT/2 {
+		t.Errorf("Write error took %v to report", d)
+	}
+	if m.Error != io.ErrUnexpectedEOF {
+		t.Errorf("Expected write error, got %v", m.Error)
+	}
+	if s.msg.Load() == m {
+		t.Errorf("Exchange still handed over to the reader")
+	}
+}
+
+// With echo, another master's request in our response window is found
+// again after the echo when resynchronising
+func TestSerialInjectEchoResync(t *testing.T) {
+	s, fp, sub := tFakeSerial(t, &SerialConfig{Device: "fake", Echo: true, Retry: RetryConfig{MaxAttempts: 1}})
+	m := NewReadRequest(1, 4, 33000, 1)
+	req := tHex(t, "0103A8610001")
+	req = append(req, ModbusCRC(req)...)
+	rep := tHex(t, "0103020005")
+	rep = append(rep, ModbusCRC(rep)...)
+	go func() {
+		<-fp.tx
+		fp.play(tStep{tTurnaround, append(append([]byte(nil), m.Request...), req...)}, tStep{tTurnaround, rep})
+	}()
+	tWaitResponse(t, tInject(t, s, m), 2*BUSY_TIMEOUT+s.exchangeTimeout(m))
+	if m.Error == nil {
+		t.Errorf("Expected failure, got %+v", m)
+	}
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case pub := <-sub:
+			if !pub.Sniffed {
+				continue
+			}
+			if pub.Error != nil || pub.Function != 3 || pub.Base != 43105 || !bytes.Equal(pub.Response, rep) {
+				t.Errorf("Unexpected exchange: %+v", pub)
+			}
+			if v := testutil.ToFloat64(s.resyncDiscarded); v != 0 {
+				t.Errorf("Discarded %v bytes", v)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("Other master's exchange not recovered")
+		}
+	}
+}
+
+// After the echo, a response split by an inter-byte gap fails the
+// injected exchange, and our own request must not then be published as
+// sniffed from another master
+func TestSerialInjectEchoSplitResponse(t *testing.T) {
+	s, fp, sub := tFakeSerial(t, &SerialConfig{Device: "fake", Echo: true, Retry: RetryConfig{MaxAttempts: 1}})
+	m := NewReadRequest(1, 4, 33000, 1)
+	rep := tHex(t, "01040231056CA3")
+	go func() {
+		<-fp.tx
+		echo := append([]byte(nil), m.Request...)
+		fp.play(tStep{tTurnaround, append(echo, rep[:3]...)}, tStep{s.interByteTimeout * 3 / 2, rep[3:]})
+	}()
+	tWaitResponse(t, tInject(t, s, m), 2*BUSY_TIMEOUT+s.exchangeTimeout(m))
+	if m.Error != ERR_TIMEOUT {
+		t.Errorf("Expected timeout, got %+v", m)
+	}
+	timeout := time.After(RESPONSE_TIMEOUT)
+	for {
+		select {
+		case pub := <-sub:
+			if pub.Sniffed && bytes.Equal(pub.Request, m.Request) {
+				t.Fatalf("Own request published as sniffed: %+v", pub)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+// Resynchronising RTU framer.  After a framing error we no longer know
+// where frames start.  Rather than discarding everything until the line
+// goes quiet, keep the bytes received and look for valid frames in them,
+// by trying the lengths that the modbus parser expects and checking the
+// CRC, then pair up requests and responses again.
+
+import (
+	"time"
+)
+
+type rtuFramer struct {
+	buf       []byte
+	pending   *ModbusExchange // request awaiting its response
+	discarded int             // bytes which were not part of any usable frame
+	synced    bool            // a valid frame has been found
+}
+
+// Is the start of the buffer a valid frame?  Returns its length, or
+// 0 with ok == true if more bytes are needed to tell, or ok == false if
+// there is no valid frame here.
+func frameAt(buf []byte, parse func([]byte) int, m *ModbusExchange) (n int, ok bool) {
+	k := 2
+	for {
+		if k > len(buf) || k > MAX_FRAME_CHARS {
+			return 0, k <= MAX_FRAME_CHARS
+		}
+		rem := parse(buf[:k])
+		if rem == 0 {
+			if m.Error != nil {
+				return 0, false
+			}
+			return k, true
+		}
+		k += rem
+	}
+}
+
+func (f *rtuFramer) tryRequest() (*ModbusExchange, int, bool) {
+	m := &ModbusExchange{Sniffed: true}
+	n, ok := frameAt(f.buf, m.ParseRequest, m)
+	return m, n, ok
+}
+
+func (f *rtuFramer) tryResponse(m *ModbusExchange) (int, bool) {
+	return frameAt(f.buf, m.ParseResponse, m)
+}
+
+// A response whose request we missed
+func (f *rtuFramer) tryOrphan() (int, bool) {
+	m := &ModbusExchange{Station: f.buf[0], Function: f.buf[1] & 0x7f}
+	return f.tryResponse(m)
+}
+
+// Take the first n bytes of the buffer
+func (f *rtuFramer) take(n int) []byte {
+	pkt := append([]byte(nil), f.buf[:n]...)
+	f.buf = f.buf[n:]
+	f.synced = true
+	return pkt
+}
+
+func (f *rtuFramer) skip(n int) {
+	f.buf = f.buf[n:]
+	f.discarded += n
+}
+
+// Add received bytes, returning any complete exchanges found
+func (f *rtuFramer) feed(data []byte) []*ModbusExchange {
+	var found []*ModbusExchange
+	f.buf = append(f.buf, data...)
+	for len(f.buf) >= 2 {
+		if f.pending != nil {
+			rn, rok := f.tryResponse(f.pending)
+			if rn > 0 {
+				m := f.pending
+				f.pending = nil
+				m.ParseResponse(f.take(rn))
+				found = append(found, m)
+				continue
+			}
+			req, qn, qok := f.tryRequest()
+			if qn > 0 {
+				// The pending request was never answered
+				f.pending = nil
+				f.request(req, qn, &found)
+				continue
+			}
+			if rok || qok {
+				break // need more bytes
+			}
+			f.pending = nil
+		}
+
+		req, qn, qok := f.tryRequest()
+		if qn > 0 {
+			f.request(req, qn, &found)
+			continue
+		}
+		on, ook := f.tryOrphan()
+		if on > 0 {
+			f.take(on)
+			f.discarded += on
+			continue
+		}
+		if qok || ook {
+			break // need more bytes
+		}
+		f.skip(1)
+	}
+	return found
+}
+
+func (f *rtuFramer) request(m *ModbusExchange, n int, found *[]*ModbusExchange) {
+	m.ParseRequest(f.take(n))
+	m.RequestStart = time.Now() // approximate; other timings are unknown
+	if m.Station == 0 {
+		*found = append(*found, m) // broadcast: no response
+	} else {
+		f.pending = m
+	}
+}
+
+// At a frame boundary, with no exchange in progress
+func (f *rtuFramer) aligned() bool {
+	return f.synced && len(f.buf) == 0 && f.pending == nil
+}
+
+// Give up on anything remaining, returning the total bytes discarded
+func (f *rtuFramer) flush() int {
+	f.discarded += len(f.buf)
+	f.buf = nil
+	f.pending = nil
+	return f.discarded
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func tHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("Invalid hex: %v: %v", s, err)
+	}
+	return b
+}
+
+func TestFramerResync(t *testing.T) {
+	stream := "" +
+		"0231056CA3" + // tail of a response we joined part-way through
+		"01040BB7000183C8" + "018402C2C1" + // request, exception response
+		"01040231056CA3" + // response to a request we missed
+		"010480E80001983E" + "01040231056CA3" + // request, response
+		"0106A8010001" + "0000" + // write with bad CRC
+		"0006A80A0001" // broadcast, CRC added below
+	b := tHex(t, stream)
+	bcast := b[len(b)-6:]
+	b = append(b, ModbusCRC(bcast)...)
+
+	// Feed a few bytes at a time, as they might arrive
+	f := &rtuFramer{}
+	var found []*ModbusExchange
+	for len(b) > 0 {
+		n := 3
+		if n > len(b) {
+			n = len(b)
+		}
+		found = append(found, f.feed(b[:n])...)
+		b = b[n:]
+	}
+	if len(found) != 3 {
+		t.Fatalf("Expected 3 exchanges, got %d", len(found))
+	}
+	if m := found[0]; m.Base != 2999 || m.Exception != 2 || !m.Sniffed {
+		t.Errorf("Unexpected exchange 0: %+v", m)
+	}
+	if m := found[1]; m.Base != 33000 || m.Count != 1 || m.Error != nil || len(m.Data) != 2 {
+		t.Errorf("Unexpected exchange 1: %+v", m)
+	}
+	if m := found[2]; m.Station != 0 || m.Function != 6 || m.Base != 43018 {
+		t.Errorf("Unexpected exchange 2: %+v", m)
+	}
+	if !f.aligned() {
+		t.Errorf("Framer not aligned at end of stream")
+	}
+	if n := f.flush(); n != 5+7+8 {
+		t.Errorf("Expected 20 bytes discarded, got %d", n)
+	}
+}
+
+func TestFramerUnanswered(t *testing.T) {
+	f := &rtuFramer{}
+	// A request whose response never came, followed by another exchange
+	found := f.feed(tHex(t, "010481E20025B9DB010480E80001983E01040231056CA3"))
+	if len(found) != 1 || found[0].Base != 33000 || found[0].Error != nil {
+		t.Fatalf("Unexpected exchanges: %+v", found)
+	}
+	if !f.aligned() {
+		t.Errorf("Framer not aligned")
+	}
+}
@@ -11,20 +11,31 @@ import (
 )
 
 type GatewayConfig struct {
-	Listen string `yaml:"listen"`
-	Rules  []Rule `yaml:"rules"`
+	Listen  string        `yaml:"listen"`
+	Rules   []Rule        `yaml:"rules"`
+	Timeout time.Duration `yaml:"timeout"` // maximum wait in the inject queue
 }
 
+const (
+	GATEWAY_TIMEOUT  = 10 * time.Second
+	GATEWAY_PIPELINE = 16 // transactions read ahead of the one being answered
+)
+
 type Gateway struct {
 	config   *GatewayConfig
 	listener net.Listener
-	inject   chan<- *InjectMessage
+	inject   Injector
+	modbus   <-chan *ModbusExchange // for device identification
+	ident    deviceIdentities
 }
 
-func NewGateway(config *GatewayConfig, inject chan<- *InjectMessage) (*Gateway, error) {
+func NewGateway(config *GatewayConfig, inject Injector, modbus <-chan *ModbusExchange) (*Gateway, error) {
 	if config.Listen == "" {
 		config.Listen = "127.0.0.1:502"
 	}
+	if config.Timeout == 0 {
+		config.Timeout = GATEWAY_TIMEOUT
+	}
 	listener, err := net.Listen("tcp", config.Listen)
 	if err != nil {
 		return nil, err
@@ -32,23 +43,51 @@ func NewGateway(config *GatewayConfig, inject chan<- *InjectMessage) (*Gateway,
 	e := &Gateway{
 		config:   config,
 		inject:   inject,
+		modbus:   modbus,
 		listener: listener,
 	}
 	return e, nil
 }
 
-func (g *Gateway) handleConnection(conn net.Conn) {
-	defer conn.Close()
-	responseChan := make(chan struct{})
+// Writes are sent ahead of any queued reads
+func gatewayPriority(m *ModbusExchange) int {
+	switch m.Function {
+	case 5, 6, 15, 16, 22, 23:
+		return PRIORITY_HIGH
+	}
+	return PRIORITY_NORMAL
+}
+
+// Exception code to return to the client when an exchange failed
+func gatewayException(err error) byte {
+	switch err {
+	case ERR_TIMEOUT:
+		return 0x0B // gateway target device failed to respond
+	case ERR_QUEUE_FULL, ERR_EXPIRED, ERR_COLLISION:
+		return 0x06 // server device busy: try again later
+	case ERR_NOT_CONNECTED, ERR_LISTEN_ONLY:
+		return 0x0A // gateway path unavailable
+	}
+	return 0x04 // server device failure, e.g. CRC error or mismatched response
+}
+
+// An MBAP frame from the client
+type mbapFrame struct {
+	header  []byte // txID(2), protocol(2), length(2)
+	request []byte // unit ID and PDU
+}
+
+// Read whole frames from the client into frames, so that it can send
+// further transactions while earlier ones are being answered.  Stops when
+// the client disconnects or breaks the framing.
+func readFrames(conn io.Reader, frames chan<- *mbapFrame, done <-chan struct{}) {
+	defer close(frames)
 	for {
-		// Read 6 bytes: txID(2), protocol(2), length(2)
-		header := make([]byte, 6, 6)
-		n, err := conn.Read(header)
-		if err == io.EOF {
-			return
-		}
-		if err != nil || n < 6 {
-			log.Printf("Read request header: %d: %v", n, err)
+		header := make([]byte, 6)
+		if n, err := io.ReadFull(conn, header); err != nil {
+			if err != io.EOF {
+				log.Printf("Read request header: %d: %v", n, err)
+			}
 			return
 		}
 		proto := binary.BigEndian.Uint16(header[2:4])
@@ -56,73 +95,121 @@ func (g *Gateway) handleConnection(conn net.Conn) {
 			log.Printf("Proto: got %d", proto)
 			return
 		}
+		// The length covers the unit ID and a PDU of at most 253 bytes.
+		// Beyond that we can no longer trust where the next frame starts.
 		l := binary.BigEndian.Uint16(header[4:6])
-		if l < 2 || l > 256 {
+		if l < 2 || l > 254 {
 			log.Printf("Len: got %d", l)
 			return
 		}
-		request := make([]byte, l, l)
-		n, err = conn.Read(request)
-		if err != nil || n < int(l) {
+		request := make([]byte, l)
+		if n, err := io.ReadFull(conn, request); err != nil {
 			log.Printf("Read request body: %d: %v", n, err)
 			return
 		}
-
-		// Parse and validate the request
-		m := &ModbusExchange{}
-		request = append(request, ModbusCRC(request)...)
-		var response []byte
-		rem := m.ParseRequest(request)
-		if rem != 0 || m.Error != nil {
-			log.Printf("Gateway: incomplete or invalid packet: %d: %v", rem, m.Error)
-			response = []byte{request[0], request[1] | 0x80, 1}
-			goto SendResponse
-		}
-		if !CheckRules(m, g.config.Rules) {
-			log.Printf("Gateway: Rejected by rules: reg %d, count %d, function %d", m.Base, m.Count, m.Function)
-			response = []byte{request[0], request[1] | 0x80, 2}
-			goto SendResponse
+		select {
+		case frames <- &mbapFrame{header: header, request: request}:
+		case <-done:
+			return
 		}
+	}
+}
 
-		// Inject it
-		g.inject <- &InjectMessage{
-			Modbus:       m,
-			ResponseChan: responseChan,
-		}
-		<-responseChan
-		if m.Station == 0 {
-			// No response to broadcast
+func (g *Gateway) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	frames := make(chan *mbapFrame, GATEWAY_PIPELINE)
+	done := make(chan struct{})
+	defer close(done)
+	go readFrames(conn, frames, done)
+
+	// Transactions are answered one at a time, in the order received
+	for f := range frames {
+		response := g.handleRequest(f.request)
+		if response == nil {
 			continue
 		}
-		if m.Error != nil {
-			log.Printf("Error in exchange: %v", m.Error)
-			// Should we turn this into a modbus exception response?
-			// Easier just to drop the connection on the floor
+		binary.BigEndian.PutUint16(f.header[4:6], uint16(len(response)))
+		if n, err := conn.Write(append(f.header, response...)); err != nil {
+			log.Printf("Write response: %d: %v", n, err)
 			return
 		}
-		if len(m.Response) < 5 {
-			log.Printf("Too short response! %d", len(m.Response))
-			return
-		}
-		response = m.Response[0 : len(m.Response)-2] // strip CRC
+	}
+}
 
-	SendResponse:
-		binary.BigEndian.PutUint16(header[4:6], uint16(len(response)))
-		n, err = conn.Write(header)
-		if err != nil || n < 6 {
-			log.Printf("Write response header: %d: %v", n, err)
-			return
+// Handle a request (unit ID and PDU), returning the response, or nil if
+// there is none
+func (g *Gateway) handleRequest(request []byte) []byte {
+	exception := func(code byte) []byte {
+		return []byte{request[0], request[1] | 0x80, code}
+	}
+
+	// Parse and validate the request
+	m := &ModbusExchange{}
+	request = append(request, ModbusCRC(request)...)
+	rem := m.ParseRequest(request)
+	if request[1] == 0x2B {
+		// Answered without going to the bus, but only for stations
+		// which the client may talk to
+		if request[0] == 0 {
+			return nil // no response to broadcast
 		}
-		n, err = conn.Write(response)
-		if err != nil || n < len(response) {
-			log.Printf("Write response body: %d: %v", n, err)
-			return
+		if !checkStation(request[0], g.config.Rules) {
+			log.Printf("Gateway: Rejected by rules: station %d, function %d", request[0], request[1])
+			return exception(2)
 		}
+		return append([]byte{request[0]}, g.ident.respond(request[0], request[1:len(request)-2])...)
 	}
+	if rem != 0 || m.Error != nil {
+		// A known function needs more than two bytes to be complete
+		if (&ModbusExchange{}).ParseRequest(request[:2]) == 0 {
+			log.Printf("Gateway: unknown function %d", request[1])
+			return exception(1)
+		}
+		// The MBAP length doesn't match the PDU, or a value is bad
+		log.Printf("Gateway: incomplete or invalid packet: length %d: %d: %v", len(request)-2, rem, m.Error)
+		return exception(3)
+	}
+	if !CheckRules(m, g.config.Rules) {
+		log.Printf("Gateway: Rejected by rules: reg %d, count %d, function %d", m.Base, m.Count, m.Function)
+		return exception(2)
+	}
+
+	// Inject it
+	responseChan := make(chan struct{}, 1)
+	err := g.inject.Submit(&InjectMessage{
+		Modbus:       m,
+		ResponseChan: responseChan,
+		Source:       "gateway",
+		Priority:     gatewayPriority(m),
+		Deadline:     time.Now().Add(g.config.Timeout),
+	})
+	if err == nil {
+		<-responseChan
+		err = m.Error
+	}
+	if m.Station == 0 {
+		// No response to broadcast
+		return nil
+	}
+	if err == nil && len(m.Response) < 5 {
+		log.Printf("Too short response! %d", len(m.Response))
+		err = ERR_INVALID
+	}
+	if err != nil {
+		log.Printf("Gateway: %v", err)
+		return exception(gatewayException(err))
+	}
+	// Including any exception from the inverter
+	return m.Response[0 : len(m.Response)-2] // strip CRC
 }
 
 func (g *Gateway) Run() {
 	log.Printf("Starting modbus TCP gateway on %s", g.config.Listen)
+	go func() {
+		for m := range g.modbus {
+			g.ident.observe(m)
+		}
+	}()
 	for {
 		conn, err := g.listener.Accept()
 		if err != nil {
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Answers from the simulator, except that each request in turn fails with
+// the next of errs (nil to let one through)
+type tFailingInjector struct {
+	tFakeInjector
+	errs []error
+}
+
+func (f *tFailingInjector) Submit(i *InjectMessage) error {
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		switch err {
+		case nil:
+		case ERR_QUEUE_FULL:
+			return err
+		default:
+			i.Modbus.Error = err
+			go func() {
+				i.ResponseChan <- struct{}{}
+			}()
+			return nil
+		}
+	}
+	return f.tFakeInjector.Submit(i)
+}
+
+// A gateway handling one connection, and the client end of it
+func tGatewayConn(t *testing.T, inject Injector) net.Conn {
+	g := &Gateway{
+		config: &GatewayConfig{Rules: []Rule{{From: 0, To: 65535}}, Timeout: GATEWAY_TIMEOUT},
+		inject: inject,
+	}
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go g.handleConnection(server)
+	return client
+}
+
+// A request ADU: MBAP header, then the unit ID and PDU
+func tMBAP(txid uint16, pdu []byte) []byte {
+	adu := make([]byte, 6, 6+len(pdu))
+	binary.BigEndian.PutUint16(adu[0:2], txid)
+	binary.BigEndian.PutUint16(adu[4:6], uint16(len(pdu)))
+	return append(adu, pdu...)
+}
+
+// Read a response, and return it after the MBAP header
+func tGatewayResponse(t *testing.T, conn net.Conn, txid uint16) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("Read header: %v", err)
+	}
+	if binary.BigEndian.Uint16(header[0:2]) != txid {
+		t.Errorf("Expected transaction ID %04X, got % X", txid, header)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(header[4:6]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatalf("Read response: %v", err)
+	}
+	return resp
+}
+
+func tGatewayRequest(t *testing.T, conn net.Conn, txid uint16, pdu []byte) []byte {
+	t.Helper()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(tMBAP(txid, pdu)); err != nil {
+		t.Fatalf("Write request: %v", err)
+	}
+	return tGatewayResponse(t, conn, txid)
+}
+
+// Failed exchanges become exception responses, and the connection stays
+// open for the next request
+func TestGatewayExceptions(t *testing.T) {
+	inject := &tFailingInjector{
+		tFakeInjector: tFakeInjector{sim: tSimulator(t)},
+		errs:          []error{ERR_TIMEOUT, ERR_CRC_FAILED, ERR_RESPONSE_MISMATCH, ERR_QUEUE_FULL, ERR_EXPIRED},
+	}
+	conn := tGatewayConn(t, inject)
+	read := tHex(t, "010480E80001")
+	for i, exception := range []byte{0x0B, 0x04, 0x04, 0x06, 0x06} {
+		if resp := tGatewayRequest(t, conn, uint16(i), read); !bytes.Equal(resp, []byte{0x01, 0x84, exception}) {
+			t.Errorf("Request %d: expected exception %02X, got % X", i, exception, resp)
+		}
+	}
+
+	// An exception from the inverter itself is passed through
+	if resp := tGatewayRequest(t, conn, 10, tHex(t, "010400000001")); !bytes.Equal(resp, []byte{0x01, 0x84, 0x02}) {
+		t.Errorf("Expected inverter exception, got % X", resp)
+	}
+
+	if resp := tGatewayRequest(t, conn, 11, read); !bytes.Equal(resp, tHex(t, "0104023105")) {
+		t.Errorf("Unexpected response: % X", resp)
+	}
+}
+
+// Several transactions sent back to back, split at arbitrary points, are
+// answered in order
+func TestGatewayPipelined(t *testing.T) {
+	conn := tGatewayConn(t, &tFailingInjector{
+		tFakeInjector: tFakeInjector{sim: tSimulator(t)},
+		errs:          []error{nil, ERR_TIMEOUT},
+	})
+	tests := []struct {
+		pdu, resp string
+	}{
+		{"010480E80001", "0104023105"},
+		{"010480E80001", "01840B"},
+		{"010480E8", "018403"},       // too short for function 4
+		{"010480E8000100", "018403"}, // too long
+		{"0107", "018701"},           // unknown function
+		{"010480E80001", "0104023105"},
+	}
+	var stream []byte
+	for i, tc := range tests {
+		stream = append(stream, tMBAP(uint16(0x100+i), tHex(t, tc.pdu))...)
+	}
+	go func() {
+		for i := 0; len(stream) > 0; i++ {
+			n := i%5 + 1
+			if n > len(stream) {
+				n = len(stream)
+			}
+			if _, err := conn.Write(stream[:n]); err != nil {
+				return
+			}
+			stream = stream[n:]
+		}
+	}()
+	for i, tc := range tests {
+		if resp := tGatewayResponse(t, conn, uint16(0x100+i)); !bytes.Equal(resp, tHex(t, tc.resp)) {
+			t.Errorf("%s: expected %s, got % X", tc.pdu, tc.resp, resp)
+		}
+	}
+}
+
+// The connection is closed when the framing can't be trusted
+func TestGatewayBadFraming(t *testing.T) {
+	for _, header := range []string{
+		"000100010006", // protocol not modbus
+		"000100000001", // length too short for unit ID and function
+		"0001000000FF", // length too long for any PDU
+	} {
+		conn := tGatewayConn(t, &tFakeInjector{sim: tSimulator(t)})
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		go conn.Write(append(tHex(t, header), tHex(t, "010480E80001")...))
+		if n, err := io.ReadFull(conn, make([]byte, 6)); err != io.EOF {
+			t.Errorf("%s: expected connection closed, got %d: %v", header, n, err)
+		}
+	}
+}
@@ -8,6 +8,12 @@ import (
 
 var config *Config
 
+// Source of modbus exchanges: the live bus, or a replayed capture
+type ModbusSource interface {
+	Subscribe(name string, buflen int, filter *Filter) *Subscription
+	Unsubscribe(sub *Subscription)
+}
+
 func main() {
 	var err error
 	var cf = flag.String("config", "solis_exporter.yml", "path to configuration file")
@@ -18,56 +24,49 @@ func main() {
 		log.Fatalf("read config: %s\n", err)
 	}
 
-	var serial *Serial
-	if config.Serial != nil {
-		serial, err = NewSerial(config.Serial)
+	// Create the simulator first, so the exporter can open its pty
+	var simulator *Simulator
+	if config.Simulator != nil {
+		simulator, err = NewSimulator(config.Simulator)
 		if err != nil {
-			log.Fatalf("serial: %s\n", err)
-		}
-		if config.Serial.Dump {
-			log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+			log.Fatalf("simulator: %s\n", err)
 		}
 	}
 
-	var exporter *SolisExporter
+	var metrics *MetricsServer
 	if config.SolisExporter != nil {
-		exporter, err = NewSolisExporter(config.SolisExporter, serial.Subscribe(5))
-		if err != nil {
-			log.Fatalf("solis_exporter: %s\n", err)
-		}
+		metrics = NewMetricsServer(config.SolisExporter)
 	}
 
-	var gateway *Gateway
-	if config.Gateway != nil {
-		if serial == nil {
-			log.Fatalf("gateway requires serial")
-		}
-		gateway, err = NewGateway(config.Gateway, serial.Inject)
+	var buses []*Bus
+	for _, bc := range config.Buses {
+		bus, err := NewBus(bc, metrics)
 		if err != nil {
-			log.Fatalf("gateway: %s\n", err)
+			log.Fatalf("%s\n", err)
 		}
+		buses = append(buses, bus)
 	}
 
 	var wg sync.WaitGroup
-	if exporter != nil {
+	if metrics != nil {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			exporter.Run()
+			metrics.Run()
 		}()
 	}
-	if gateway != nil {
+	for _, bus := range buses {
 		wg.Add(1)
-		go func() {
+		go func(bus *Bus) {
 			defer wg.Done()
-			gateway.Run()
-		}()
+			bus.Run()
+		}(bus)
 	}
-	if serial != nil {
+	if simulator != nil {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			serial.Run()
+			simulator.Run()
 		}()
 	}
 	wg.Wait()
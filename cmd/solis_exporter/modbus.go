@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"time"
 
 	"github.com/sigurn/crc16"
 )
@@ -19,8 +20,10 @@ var ERR_INVALID = fmt.Errorf("Invalid or unknown packet format")
 var ERR_TIMEOUT = fmt.Errorf("Too few bytes received")
 var ERR_CRC_FAILED = fmt.Errorf("CRC check failed")
 var ERR_RESPONSE_MISMATCH = fmt.Errorf("Response packet does not match request")
+var ERR_COLLISION = fmt.Errorf("Another device transmitted during our exchange")
 
 var modbusErrorToLabel = map[error]string{
+	ERR_COLLISION:         "collision",
 	ERR_CRC_FAILED:        "crc_failed",
 	ERR_INVALID:           "decode_failed",
 	ERR_RESPONSE_MISMATCH: "response_mismatch",
@@ -39,6 +42,16 @@ type ModbusExchange struct {
 	Base      uint16 // base register ID
 	Count     uint16 // number of registers in request or response
 	Data      []byte // sub-slice containing the request or response data
+
+	// Function 23 reads Base/Count and writes these registers
+	WriteBase  uint16
+	WriteCount uint16
+	WriteData  []byte
+
+	RequestStart  time.Time // first request byte received or sent
+	RequestEnd    time.Time // last request byte received or sent
+	ResponseStart time.Time // first response byte received
+	ResponseEnd   time.Time // last response byte received
 }
 
 // Parse a complete or partial modbus request.  If it is incomplete,
@@ -58,16 +71,25 @@ func (m *ModbusExchange) ParseRequest(pkt []byte) int {
 	}
 	var exp int
 	switch pkt[1] {
-	case 0x02, 0x03, 0x04, 0x06:
+	case 0x01, 0x02, 0x03, 0x04, 0x05, 0x06:
 		// STA-1 FUN-1 REG-2 CNT-2 CRC-2
-		// STA-1 FUN-1 REG-2 VAL-2 CRC-2  # 06
+		// STA-1 FUN-1 REG-2 VAL-2 CRC-2  # 05, 06
 		exp = 8
-	case 0x10:
+	case 0x0F, 0x10:
 		// STA-1 FUN-1 REG-2 CNT-2 LEN-1 DATA-LEN CRC-2
 		if l < 7 {
 			return 9 - l
 		}
 		exp = int(pkt[6]) + 9
+	case 0x16:
+		// STA-1 FUN-1 REG-2 AND-2 OR-2 CRC-2
+		exp = 10
+	case 0x17:
+		// STA-1 FUN-1 RREG-2 RCNT-2 WREG-2 WCNT-2 LEN-1 DATA-LEN CRC-2
+		if l < 11 {
+			return 13 - l
+		}
+		exp = int(pkt[10]) + 13
 	}
 
 	// Don't know?
@@ -97,10 +119,19 @@ func (m *ModbusExchange) ParseRequest(pkt []byte) int {
 	m.Function = pkt[1]
 
 	switch m.Function {
-	case 0x02, 0x03, 0x04:
+	case 0x01, 0x02, 0x03, 0x04:
 		// STA-1 FUN-1 REG-2 CNT-2 CRC-2
 		m.Base = binary.BigEndian.Uint16(pkt[2:])
 		m.Count = binary.BigEndian.Uint16(pkt[4:])
+	case 0x05:
+		// STA-1 FUN-1 REG-2 VAL-2 CRC-2, where VAL is FF00 (on) or 0000 (off)
+		m.Base = binary.BigEndian.Uint16(pkt[2:])
+		m.Count = 1
+		m.Data = pkt[4:6]
+		if (pkt[4] != 0xFF && pkt[4] != 0x00) || pkt[5] != 0x00 {
+			m.Error = ERR_INVALID
+			return 0
+		}
 	case 0x06:
 		// STA-1 FUN-1 REG-2 VAL-2 CRC-2
 		m.Base = binary.BigEndian.Uint16(pkt[2:])
@@ -115,6 +146,31 @@ func (m *ModbusExchange) ParseRequest(pkt []byte) int {
 			m.Error = ERR_INVALID // should not happen
 			return 0
 		}
+	case 0x0F:
+		// STA-1 FUN-1 REG-2 CNT-2 LEN-1 DATA-LEN CRC-2, one bit per coil
+		m.Base = binary.BigEndian.Uint16(pkt[2:])
+		m.Count = binary.BigEndian.Uint16(pkt[4:])
+		m.Data = pkt[7:plen]
+		if int(pkt[6]) != len(m.Data) || len(m.Data) != coilBytes(m.Count) {
+			m.Error = ERR_INVALID
+			return 0
+		}
+	case 0x16:
+		// STA-1 FUN-1 REG-2 AND-2 OR-2 CRC-2
+		m.Base = binary.BigEndian.Uint16(pkt[2:])
+		m.Count = 1
+		m.Data = pkt[4:8]
+	case 0x17:
+		// STA-1 FUN-1 RREG-2 RCNT-2 WREG-2 WCNT-2 LEN-1 DATA-LEN CRC-2
+		m.Base = binary.BigEndian.Uint16(pkt[2:])
+		m.Count = binary.BigEndian.Uint16(pkt[4:])
+		m.WriteBase = binary.BigEndian.Uint16(pkt[6:])
+		m.WriteCount = binary.BigEndian.Uint16(pkt[8:])
+		m.WriteData = pkt[11:plen]
+		if m.Count == 0 || m.WriteCount == 0 || len(m.WriteData) != int(m.WriteCount)*2 {
+			m.Error = ERR_INVALID
+			return 0
+		}
 	}
 	return 0
 }
@@ -136,16 +192,19 @@ func (m *ModbusExchange) ParseResponse(pkt []byte) int {
 		exp = 5
 	} else {
 		switch m.Function {
-		case 0x02, 0x03, 0x04:
+		case 0x01, 0x02, 0x03, 0x04, 0x17:
 			// STA-1 FUN-1 LEN-1 DATA-LEN CRC-2
 			if l < 3 {
 				return 5
 			}
 			exp = int(pkt[2]) + 5
-		case 0x06, 0x10:
+		case 0x05, 0x06, 0x0F, 0x10:
 			// STA-1 FUN-1 REG-2 VAL-2 CRC-2
 			// STA-1 FUN-1 REG-2 CNT-2 CRC-2
 			exp = 8
+		case 0x16:
+			// STA-1 FUN-1 REG-2 AND-2 OR-2 CRC-2
+			exp = 10
 		}
 	}
 
@@ -185,13 +244,32 @@ func (m *ModbusExchange) ParseResponse(pkt []byte) int {
 	}
 
 	switch m.Function {
-	case 0x02, 0x03, 0x04:
+	case 0x01, 0x02:
+		// STA-1 FUN-1 LEN-1 DATA-LEN CRC-2, one bit per coil or input
+		m.Data = pkt[3:plen]
+		if int(pkt[2]) != len(m.Data) {
+			m.Error = ERR_INVALID // should not happen
+			return 0
+		}
+		if len(m.Data) != coilBytes(m.Count) {
+			m.Error = ERR_RESPONSE_MISMATCH
+			return 0
+		}
+	case 0x03, 0x04:
 		// STA-1 FUN-1 LEN-1 DATA-LEN CRC-2
 		m.Data = pkt[3:plen]
 		if int(pkt[2]) != len(m.Data) {
 			m.Error = ERR_INVALID // should not happen
 			return 0
 		}
+	case 0x05:
+		// STA-1 FUN-1 REG-2 VAL-2 CRC-2, echoing the request
+		if !bytes.Equal(pkt[2:6], m.Request[2:6]) {
+			m.Error = ERR_RESPONSE_MISMATCH
+			return 0
+		}
+		m.Count = 1
+		m.Data = pkt[4:6]
 	case 0x06:
 		// STA-1 FUN-1 REG-2 VAL-2 CRC-2
 		if binary.BigEndian.Uint16(pkt[2:]) != m.Base {
@@ -200,17 +278,77 @@ func (m *ModbusExchange) ParseResponse(pkt []byte) int {
 		}
 		m.Count = 1
 		m.Data = pkt[4:6]
-	case 0x10:
+	case 0x0F, 0x10:
 		// STA-1 FUN-1 REG-2 CNT-2 CRC-2
 		if binary.BigEndian.Uint16(pkt[2:]) != m.Base {
 			m.Error = ERR_RESPONSE_MISMATCH
 			return 0
 		}
 		m.Count = binary.BigEndian.Uint16(pkt[4:])
+	case 0x16:
+		// STA-1 FUN-1 REG-2 AND-2 OR-2 CRC-2, echoing the request
+		if !bytes.Equal(pkt[2:8], m.Request[2:8]) {
+			m.Error = ERR_RESPONSE_MISMATCH
+			return 0
+		}
+	case 0x17:
+		// STA-1 FUN-1 LEN-1 DATA-LEN CRC-2, the registers read
+		m.Data = pkt[3:plen]
+		if int(pkt[2]) != len(m.Data) {
+			m.Error = ERR_INVALID // should not happen
+			return 0
+		}
+		if len(m.Data) != int(m.Count)*2 {
+			m.Error = ERR_RESPONSE_MISMATCH
+			return 0
+		}
 	}
 	return 0
 }
 
+// Clear the results of a previous attempt at the exchange, so that the
+// request can be sent again
+func (m *ModbusExchange) reset() {
+	req := m.Request
+	*m = ModbusExchange{}
+	m.ParseRequest(req)
+}
+
+// Reads can safely be repeated
+func isReadFunction(function byte) bool {
+	return function >= 1 && function <= 4
+}
+
+// Number of bytes holding count bit-packed coils or discrete inputs
+func coilBytes(count uint16) int {
+	return (int(count) + 7) / 8
+}
+
+// State of coil or discrete input Base+n, from a read response or write
+// request (functions 1, 2, 5 and 15).  Bits are packed least significant
+// first.
+func (m *ModbusExchange) Bit(n uint16) bool {
+	if n >= m.Count {
+		return false
+	}
+	if m.Function == 0x05 {
+		return len(m.Data) > 0 && m.Data[0] == 0xFF
+	}
+	if int(n/8) >= len(m.Data) {
+		return false
+	}
+	return m.Data[n/8]&(1<<(n%8)) != 0
+}
+
+// Build a read request (function 1, 2, 3 or 4) including CRC, already decoded
+func NewReadRequest(station, function byte, base, count uint16) *ModbusExchange {
+	pkt := []byte{station, function, byte(base >> 8), byte(base), byte(count >> 8), byte(count)}
+	pkt = append(pkt, ModbusCRC(pkt)...)
+	m := &ModbusExchange{}
+	m.ParseRequest(pkt)
+	return m
+}
+
 func ModbusCRC(pkt []byte) []byte {
 	crc := crc16.Checksum(pkt, crcTable)
 	return []byte{byte(crc & 0xff), byte(crc >> 8)}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
 )
 
@@ -161,3 +162,114 @@ func TestModbusCRC(t *testing.T) {
 		}
 	}
 }
+
+func tFrame(pdu ...byte) []byte {
+	return append(pdu, ModbusCRC(pdu)...)
+}
+
+func TestModbusCoils(t *testing.T) {
+	// Read 10 coils from 19: 1, 3, 4 and 10 (relative to base) are on
+	for _, f := range []byte{0x01, 0x02} {
+		m := &ModbusExchange{}
+		if n := m.ParseRequest(tFrame(0x01, f, 0x00, 0x13, 0x00, 0x0A)); n != 0 || m.Error != nil {
+			t.Fatalf("Function %d: unable to parse request: %v, %v", f, n, m.Error)
+		}
+		rep := tFrame(0x01, f, 0x02, 0x1A, 0x02)
+		if n := m.ParseResponse(rep[:4]); n != 3 {
+			t.Errorf("Function %d: expected 3 more bytes, got %d", f, n)
+		}
+		if n := m.ParseResponse(rep); n != 0 || m.Error != nil {
+			t.Fatalf("Function %d: unable to parse response: %v, %v", f, n, m.Error)
+		}
+		var on []uint16
+		for i := uint16(0); i < 12; i++ {
+			if m.Bit(i) {
+				on = append(on, i)
+			}
+		}
+		if !reflect.DeepEqual(on, []uint16{1, 3, 4, 9}) {
+			t.Errorf("Function %d: unexpected bits on: %v", f, on)
+		}
+		// Wrong number of bytes for the count requested
+		m.ParseResponse(tFrame(0x01, f, 0x01, 0x1A))
+		if m.Error != ERR_RESPONSE_MISMATCH {
+			t.Errorf("Function %d: short data not detected: %v", f, m.Error)
+		}
+	}
+
+	// Write single coil
+	m := &ModbusExchange{}
+	req := tFrame(0x01, 0x05, 0x00, 0xAC, 0xFF, 0x00)
+	if m.ParseRequest(req); m.Error != nil || m.Base != 0xAC || m.Count != 1 || !m.Bit(0) {
+		t.Errorf("Unexpected write coil request: %+v", m)
+	}
+	if m.ParseResponse(req); m.Error != nil || !m.Bit(0) {
+		t.Errorf("Unexpected write coil response: %+v", m)
+	}
+	if m.ParseResponse(tFrame(0x01, 0x05, 0x00, 0xAC, 0x00, 0x00)); m.Error != ERR_RESPONSE_MISMATCH {
+		t.Errorf("Mismatched echo not detected: %v", m.Error)
+	}
+	if m.ParseRequest(tFrame(0x01, 0x05, 0x00, 0xAC, 0x12, 0x34)); m.Error != ERR_INVALID {
+		t.Errorf("Invalid coil value not detected: %v", m.Error)
+	}
+
+	// Write multiple coils: 10 coils from 19, value 0xCD 0x01
+	m = &ModbusExchange{}
+	if m.ParseRequest(tFrame(0x01, 0x0F, 0x00, 0x13, 0x00, 0x0A, 0x02, 0xCD, 0x01)); m.Error != nil || m.Count != 10 || !m.Bit(0) || m.Bit(1) || !m.Bit(8) || m.Bit(9) {
+		t.Errorf("Unexpected write coils request: %+v", m)
+	}
+	if m.ParseResponse(tFrame(0x01, 0x0F, 0x00, 0x13, 0x00, 0x0A)); m.Error != nil || m.Count != 10 {
+		t.Errorf("Unexpected write coils response: %+v", m)
+	}
+	if m.ParseRequest(tFrame(0x01, 0x0F, 0x00, 0x13, 0x00, 0x0A, 0x01, 0xCD)); m.Error != ERR_INVALID {
+		t.Errorf("Byte count not checked against coil count: %v", m.Error)
+	}
+}
+
+func TestModbusMaskWrite(t *testing.T) {
+	// Example from the modbus specification
+	m := &ModbusExchange{}
+	req := tFrame(0x01, 0x16, 0x00, 0x04, 0x00, 0xF2, 0x00, 0x25)
+	if n := m.ParseRequest(req[:9]); n != 1 {
+		t.Errorf("Expected 1 more byte, got %d", n)
+	}
+	if m.ParseRequest(req); m.Error != nil || m.Base != 4 || m.Count != 1 || !bytes.Equal(m.Data, []byte{0x00, 0xF2, 0x00, 0x25}) {
+		t.Errorf("Unexpected mask write request: %+v", m)
+	}
+	if n := m.ParseResponse(req); n != 0 || m.Error != nil {
+		t.Errorf("Unable to parse response: %v, %v", n, m.Error)
+	}
+	if m.ParseResponse(tFrame(0x01, 0x16, 0x00, 0x04, 0x00, 0xF2, 0x00, 0x24)); m.Error != ERR_RESPONSE_MISMATCH {
+		t.Errorf("Mismatched echo not detected: %v", m.Error)
+	}
+}
+
+func TestModbusReadWrite(t *testing.T) {
+	// Example from the modbus specification: read 6 registers from 3,
+	// write 3 registers from 14
+	m := &ModbusExchange{}
+	req := tFrame(0x01, 0x17, 0x00, 0x03, 0x00, 0x06, 0x00, 0x0E, 0x00, 0x03, 0x06, 0x00, 0xFF, 0x00, 0xFF, 0x00, 0xFF)
+	if n := m.ParseRequest(req[:5]); n != 8 {
+		t.Errorf("Expected 8 more bytes, got %d", n)
+	}
+	if n := m.ParseRequest(req[:11]); n != 8 {
+		t.Errorf("Expected 8 more bytes, got %d", n)
+	}
+	m.ParseRequest(req)
+	if m.Error != nil || m.Base != 3 || m.Count != 6 || m.WriteBase != 14 || m.WriteCount != 3 || len(m.WriteData) != 6 {
+		t.Errorf("Unexpected read/write request: %+v", m)
+	}
+	rep := tFrame(0x01, 0x17, 0x0C, 0x00, 0xFE, 0x0A, 0xCD, 0x00, 0x01, 0x00, 0x03, 0x00, 0x0D, 0x00, 0xFF)
+	if n := m.ParseResponse(rep); n != 0 || m.Error != nil || len(m.Data) != 12 || m.Data[1] != 0xFE {
+		t.Errorf("Unexpected read/write response: %v, %+v", n, m)
+	}
+	if m.ParseResponse(tFrame(0x01, 0x17, 0x02, 0x00, 0xFE)); m.Error != ERR_RESPONSE_MISMATCH {
+		t.Errorf("Short response not detected: %v", m.Error)
+	}
+
+	// Byte count must match the number of registers written
+	bad := tFrame(0x01, 0x17, 0x00, 0x03, 0x00, 0x06, 0x00, 0x0E, 0x00, 0x02, 0x06, 0x00, 0xFF, 0x00, 0xFF, 0x00, 0xFF)
+	if m.ParseRequest(bad); m.Error != ERR_INVALID {
+		t.Errorf("Invalid write count not detected: %v", m.Error)
+	}
+}
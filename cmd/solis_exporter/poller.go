@@ -0,0 +1,181 @@
+package main
+
+// Active polling of the inverter, for installations where there is
+// no data logger on the bus.  The results are published to subscribers
+// such as the exporter, in the same way as sniffed exchanges.
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	POLLER_INTERVAL = 1 * time.Minute
+	POLLER_HOLDOFF  = 10 * time.Minute // stay quiet after seeing another master
+)
+
+type PollerConfig struct {
+	Station  byte          `yaml:"station"`
+	Interval time.Duration `yaml:"interval"`
+	Holdoff  time.Duration `yaml:"holdoff"`
+	Blocks   []PollBlock   `yaml:"blocks"`
+}
+
+// A range of registers to read with a single request
+type PollBlock struct {
+	Function byte   `yaml:"function"`
+	From     uint16 `yaml:"from"`
+	To       uint16 `yaml:"to"`
+}
+
+// The same blocks that the Solis data logger reads
+var DEFAULT_POLL_BLOCKS = []PollBlock{
+	{Function: 4, From: 33000, To: 33040},
+	{Function: 4, From: 33049, To: 33084},
+	{Function: 4, From: 33091, To: 33095},
+	{Function: 4, From: 33100, To: 33121},
+	{Function: 4, From: 33126, To: 33149},
+	{Function: 4, From: 33161, To: 33180},
+	{Function: 4, From: 33250, To: 33286},
+}
+
+type Poller struct {
+	config     *PollerConfig
+	inject     Injector
+	modbus     <-chan *ModbusExchange // to watch for other masters
+	holdUntil  atomic.Int64           // unix nanoseconds
+	polls      *prometheus.CounterVec
+	backingOff prometheus.Gauge
+}
+
+func NewPoller(config *PollerConfig, inject Injector, modbus <-chan *ModbusExchange) (*Poller, error) {
+	if config.Station == 0 {
+		config.Station = 1
+	}
+	if config.Interval == 0 {
+		config.Interval = POLLER_INTERVAL
+	}
+	if config.Holdoff == 0 {
+		config.Holdoff = POLLER_HOLDOFF
+	}
+	if config.Blocks == nil {
+		config.Blocks = DEFAULT_POLL_BLOCKS
+	}
+	for i := range config.Blocks {
+		b := &config.Blocks[i]
+		if b.Function == 0 {
+			b.Function = 4
+		}
+		if b.To == 0 {
+			b.To = b.From
+		}
+		if !isReadFunction(b.Function) {
+			return nil, fmt.Errorf("block %d: unsupported function %d", i, b.Function)
+		}
+		// At most 2000 coils or inputs, or 125 registers, per request
+		max := uint16(125)
+		if b.Function <= 2 {
+			max = 2000
+		}
+		if b.To < b.From || b.To-b.From >= max {
+			return nil, fmt.Errorf("block %d: invalid range %d-%d", i, b.From, b.To)
+		}
+	}
+
+	p := &Poller{
+		config: config,
+		inject: inject,
+		modbus: modbus,
+		polls: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "solis_poller_requests_total",
+				Help: "Number of requests made by the poller",
+			},
+			[]string{"result"}),
+		backingOff: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "solis_poller_backoff",
+			Help: "Whether the poller is holding off because another master was seen (1) or not (0)",
+		}),
+	}
+	for _, label := range []string{"ok", "exception", "error"} {
+		p.polls.WithLabelValues(label)
+	}
+	return p, nil
+}
+
+func (p *Poller) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{p.polls, p.backingOff}
+}
+
+// Note any sniffed traffic, which means there is another master
+func (p *Poller) watch() {
+	for m := range p.modbus {
+		if !m.Sniffed {
+			continue
+		}
+		now := time.Now()
+		if now.UnixNano() >= p.holdUntil.Load() {
+			log.Printf("Poller: another master is active, holding off for %v", p.config.Holdoff)
+		}
+		p.holdUntil.Store(now.Add(p.config.Holdoff).UnixNano())
+		p.backingOff.Set(1)
+	}
+}
+
+func (p *Poller) holding() bool {
+	if time.Now().UnixNano() < p.holdUntil.Load() {
+		return true
+	}
+	p.backingOff.Set(0)
+	return false
+}
+
+// Read each block in turn, unless another master appears
+func (p *Poller) pollOnce() {
+	responseChan := make(chan struct{})
+	for _, b := range p.config.Blocks {
+		if p.holding() {
+			return
+		}
+		m := NewReadRequest(p.config.Station, b.Function, b.From, b.To-b.From+1)
+		// Don't let stale polls pile up behind other traffic
+		err := p.inject.Submit(&InjectMessage{
+			Modbus:       m,
+			ResponseChan: responseChan,
+			Source:       "poller",
+			Priority:     PRIORITY_LOW,
+			Deadline:     time.Now().Add(p.config.Interval),
+		})
+		if err == nil {
+			<-responseChan
+		} else {
+			m.Error = err
+		}
+		if m.Error != nil {
+			log.Printf("Poller: %d-%d: %v", b.From, b.To, m.Error)
+			p.polls.WithLabelValues("error").Inc()
+		} else if m.Exception != 0 {
+			log.Printf("Poller: %d-%d: exception %d", b.From, b.To, m.Exception)
+			p.polls.WithLabelValues("exception").Inc()
+		} else {
+			p.polls.WithLabelValues("ok").Inc()
+		}
+	}
+}
+
+func (p *Poller) Run() {
+	log.Printf("Starting poller every %v", p.config.Interval)
+	if p.modbus != nil {
+		go p.watch()
+	}
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		p.pollOnce()
+		<-ticker.C
+	}
+}
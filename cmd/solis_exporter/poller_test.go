@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Answer injected requests from the simulator's register image
+type tFakeInjector struct {
+	sim  *Simulator
+	seen []*ModbusExchange
+}
+
+func (f *tFakeInjector) Submit(i *InjectMessage) error {
+	m := i.Modbus
+	if rem := m.ParseResponse(f.sim.respond(m)); rem != 0 {
+		m.Error = ERR_TIMEOUT
+	}
+	f.seen = append(f.seen, m)
+	go func() {
+		i.ResponseChan <- struct{}{}
+	}()
+	return nil
+}
+
+func TestPoller(t *testing.T) {
+	inject := &tFakeInjector{sim: tSimulator(t)}
+	p, err := NewPoller(&PollerConfig{}, inject, nil)
+	if err != nil {
+		t.Fatalf("NewPoller: %v", err)
+	}
+	p.pollOnce()
+	if len(inject.seen) != len(DEFAULT_POLL_BLOCKS) {
+		t.Fatalf("Expected %d requests, got %d", len(DEFAULT_POLL_BLOCKS), len(inject.seen))
+	}
+	e := tExporter(t)
+	for _, m := range inject.seen {
+		if m.Error != nil || m.Exception != 0 || m.Sniffed {
+			t.Errorf("Unexpected exchange: %+v", m)
+		}
+		e.handleMessage(m)
+	}
+	tTestGauges(t, e, map[uint16]float64{
+		33263: -414,
+	})
+	if v := testutil.ToFloat64(p.polls.WithLabelValues("ok")); v != float64(len(DEFAULT_POLL_BLOCKS)) {
+		t.Errorf("Unexpected ok count: %v", v)
+	}
+}
+
+func TestPollerBackoff(t *testing.T) {
+	inject := &tFakeInjector{sim: tSimulator(t)}
+	modbus := make(chan *ModbusExchange)
+	p, err := NewPoller(&PollerConfig{}, inject, modbus)
+	if err != nil {
+		t.Fatalf("NewPoller: %v", err)
+	}
+	go p.watch()
+
+	// Our own injected exchanges don't count
+	modbus <- &ModbusExchange{Sniffed: false}
+	modbus <- &ModbusExchange{Sniffed: false}
+	if p.holding() {
+		t.Errorf("Backing off because of own traffic")
+	}
+
+	// Another master's exchange does
+	modbus <- &ModbusExchange{Sniffed: true}
+	modbus <- &ModbusExchange{Sniffed: true} // wait until first processed
+	p.pollOnce()
+	if len(inject.seen) != 0 {
+		t.Errorf("Poller did not back off: %d requests", len(inject.seen))
+	}
+	if v := testutil.ToFloat64(p.backingOff); v != 1 {
+		t.Errorf("Backoff not reported: %v", v)
+	}
+}
+
+func TestPollerConfig(t *testing.T) {
+	for i, c := range []*PollerConfig{
+		{Blocks: []PollBlock{{Function: 6, From: 43110}}},
+		{Blocks: []PollBlock{{From: 33100, To: 33000}}},
+		{Blocks: []PollBlock{{From: 33000, To: 33200}}},
+		{Blocks: []PollBlock{{Function: 1, From: 0, To: 2000}}},
+	} {
+		if _, err := NewPoller(c, nil, nil); err == nil {
+			t.Errorf("Case %d: invalid config accepted", i)
+		}
+	}
+}
+
+func TestPollerCoils(t *testing.T) {
+	p, err := NewPoller(&PollerConfig{Blocks: []PollBlock{{Function: 1, From: 0, To: 1999}, {Function: 2, From: 10}}}, nil, nil)
+	if err != nil {
+		t.Fatalf("NewPoller: %v", err)
+	}
+	if b := p.config.Blocks[1]; b.Function != 2 || b.To != 10 {
+		t.Errorf("Unexpected block: %+v", b)
+	}
+}
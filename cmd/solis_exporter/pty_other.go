@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func openPty() (master, slave *os.File, err error) {
+	return nil, nil, fmt.Errorf("pseudo-terminals are only supported on Linux")
+}
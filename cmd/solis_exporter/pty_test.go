@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// Open a pseudo-terminal, returning the master side and the path of the slave
+func tOpenPty(t *testing.T) (*os.File, string) {
+	master, slave, err := openPty()
+	if err != nil {
+		t.Skipf("Unable to open pty: %v", err)
+	}
+	slave.Close()
+	return master, slave.Name()
+}
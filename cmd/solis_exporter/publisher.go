@@ -0,0 +1,138 @@
+package main
+
+// Distribution of modbus exchanges to subscribers, shared by the
+// serial bus handler and other sources of exchanges.  Subscribers can be
+// added and removed while running.
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Which exchanges a subscriber wants.  Zero values match anything.
+type Filter struct {
+	Station  byte   `yaml:"station"`
+	Function byte   `yaml:"function"`
+	From     uint16 `yaml:"from"` // register range, which must overlap
+	To       uint16 `yaml:"to"`   // the exchange's registers
+}
+
+func (f *Filter) Match(m *ModbusExchange) bool {
+	if f == nil {
+		return true
+	}
+	if f.Station != 0 && m.Station != f.Station {
+		return false
+	}
+	if f.Function != 0 && m.Function != f.Function {
+		return false
+	}
+	if f.From != 0 || f.To != 0 {
+		// A failed exchange's registers may not be known
+		if m.Error != nil {
+			return false
+		}
+		to := f.To
+		if to == 0 {
+			to = f.From
+		}
+		last := m.Base
+		if m.Count > 0 {
+			last = m.Base + m.Count - 1
+		}
+		if last < f.From || m.Base > to {
+			return false
+		}
+	}
+	return true
+}
+
+type Subscription struct {
+	C       <-chan *ModbusExchange
+	c       chan *ModbusExchange
+	name    string
+	filter  *Filter
+	done    chan struct{} // closed on unsubscribe
+	once    sync.Once
+	dropped prometheus.Counter
+}
+
+type publisher struct {
+	lock        sync.RWMutex // held for writing to change subscribers
+	subscribers []*Subscription
+	dropped     *prometheus.CounterVec
+}
+
+func newPublisher() *publisher {
+	return &publisher{
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "solis_subscriber_dropped_total",
+				Help: "Exchanges not delivered because the subscriber was not keeping up",
+			},
+			[]string{"subscriber"}),
+	}
+}
+
+// Add a subscriber, which receives exchanges matching filter (all if nil)
+func (p *publisher) Subscribe(name string, buflen int, filter *Filter) *Subscription {
+	c := make(chan *ModbusExchange, buflen)
+	sub := &Subscription{
+		C:       c,
+		c:       c,
+		name:    name,
+		filter:  filter,
+		done:    make(chan struct{}),
+		dropped: p.dropped.WithLabelValues(name),
+	}
+	p.lock.Lock()
+	p.subscribers = append(p.subscribers, sub)
+	p.lock.Unlock()
+	return sub
+}
+
+// Remove a subscriber and close its channel
+func (p *publisher) Unsubscribe(sub *Subscription) {
+	sub.once.Do(func() { close(sub.done) }) // release any publishMessageWait
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, s := range p.subscribers {
+		if s == sub {
+			p.subscribers = append(p.subscribers[:i:i], p.subscribers[i+1:]...)
+			close(sub.c)
+			return
+		}
+	}
+}
+
+func (p *publisher) publishMessage(m *ModbusExchange) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	// Distribute to subscribers (without blocking)
+	for _, sub := range p.subscribers {
+		if !sub.filter.Match(m) {
+			continue
+		}
+		select {
+		case sub.c <- m:
+		default:
+			sub.dropped.Inc()
+		}
+	}
+}
+
+// Distribute to subscribers, waiting for each to accept the message
+func (p *publisher) publishMessageWait(m *ModbusExchange) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for _, sub := range p.subscribers {
+		if !sub.filter.Match(m) {
+			continue
+		}
+		select {
+		case sub.c <- m:
+		case <-sub.done:
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFilterMatch(t *testing.T) {
+	m := NewReadRequest(1, 4, 33100, 22) // 33100-33121
+	for _, c := range []struct {
+		f   *Filter
+		exp bool
+	}{
+		{nil, true},
+		{&Filter{}, true},
+		{&Filter{Station: 1, Function: 4}, true},
+		{&Filter{Station: 2}, false},
+		{&Filter{Function: 3}, false},
+		{&Filter{From: 33121}, true},
+		{&Filter{From: 33122, To: 33200}, false},
+		{&Filter{From: 33000, To: 33100}, true},
+		{&Filter{From: 33000, To: 33099}, false},
+	} {
+		if got := c.f.Match(m); got != c.exp {
+			t.Errorf("%+v: got %v, expected %v", c.f, got, c.exp)
+		}
+	}
+	failed := &ModbusExchange{Station: 1, Function: 4, Error: ERR_TIMEOUT}
+	if !(&Filter{}).Match(failed) || !(&Filter{Station: 1}).Match(failed) {
+		t.Errorf("Filter without registers didn't match an error")
+	}
+	if (&Filter{From: 0, To: 65535}).Match(failed) {
+		t.Errorf("Register filter matched an error")
+	}
+}
+
+func TestPublisherSubscribe(t *testing.T) {
+	p := newPublisher()
+	all := p.Subscribe("all", 1, nil)
+	input := p.Subscribe("input", 5, &Filter{Function: 4})
+
+	p.publishMessage(NewReadRequest(1, 4, 33000, 1))
+	p.publishMessage(NewReadRequest(1, 3, 43000, 1))
+	if len(all.C) != 1 || len(input.C) != 1 {
+		t.Errorf("Unexpected deliveries: %d %d", len(all.C), len(input.C))
+	}
+	if v := testutil.ToFloat64(p.dropped.WithLabelValues("all")); v != 1 {
+		t.Errorf("Expected 1 dropped, got %v", v)
+	}
+	if v := testutil.ToFloat64(p.dropped.WithLabelValues("input")); v != 0 {
+		t.Errorf("Expected none dropped, got %v", v)
+	}
+
+	p.Unsubscribe(input)
+	p.Unsubscribe(input) // harmless
+	<-input.C
+	if _, ok := <-input.C; ok {
+		t.Errorf("Channel not closed on unsubscribe")
+	}
+	p.publishMessage(NewReadRequest(1, 4, 33000, 1))
+	if len(p.subscribers) != 1 {
+		t.Errorf("Expected 1 subscriber, got %d", len(p.subscribers))
+	}
+}
+
+// Unsubscribing must release a publisher waiting for the subscriber
+func TestPublisherUnsubscribeWait(t *testing.T) {
+	p := newPublisher()
+	sub := p.Subscribe("slow", 0, nil)
+	done := make(chan struct{})
+	go func() {
+		p.publishMessageWait(NewReadRequest(1, 4, 33000, 1))
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Unsubscribe(sub)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Publisher still blocked after unsubscribe")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+// Queue of requests waiting to be injected onto the bus.  The serial port
+// handler takes the highest priority request whenever the line is idle,
+// subject to per-source rate limits; requests which wait past their
+// deadline are dropped without being sent.
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	PRIORITY_LOW    = 0 // background reads, e.g. by the poller
+	PRIORITY_NORMAL = 1 // reads on behalf of a gateway client
+	PRIORITY_HIGH   = 2 // user-initiated writes
+
+	INJECT_QUEUE_DEPTH = 16
+)
+
+var ERR_QUEUE_FULL = fmt.Errorf("Inject queue full")
+var ERR_EXPIRED = fmt.Errorf("Request expired before it could be sent")
+
+type InjectQueueConfig struct {
+	MaxDepth   int                  `yaml:"max_depth"`
+	RateLimits map[string]RateLimit `yaml:"rate_limits"` // by source
+}
+
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`  // requests per second
+	Burst int     `yaml:"burst"` // requests which may be sent back-to-back
+}
+
+// Anything which requests can be submitted to for injection
+type Injector interface {
+	Submit(i *InjectMessage) error
+}
+
+type InjectMessage struct {
+	Modbus       *ModbusExchange // already-decoded request, including CRC
+	ResponseChan chan struct{}   // exchange complete; response will have been added to Modbus
+	Source       string          // for rate limiting and metrics
+	Priority     int             // higher is sent first
+	Deadline     time.Time       // drop if not sent by this time (optional)
+	queued       time.Time
+	attempts     int       // number of times resent
+	notBefore    time.Time // don't resend until this time
+	heldBack     bool      // counted in collisions avoided
+}
+
+func (i *InjectMessage) expired(now time.Time) bool {
+	return !i.Deadline.IsZero() && now.After(i.Deadline)
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Time until a token is available
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+type InjectQueue struct {
+	config  *InjectQueueConfig
+	lock    sync.Mutex
+	queue   []*InjectMessage // in order of submission
+	buckets map[string]*tokenBucket
+	ready   chan struct{} // a request may be ready to send
+	refuse  error         // returned by Submit, if nothing can be sent
+	depth   prometheus.Gauge
+	waiting prometheus.Histogram
+	dropped *prometheus.CounterVec
+}
+
+func NewInjectQueue(config *InjectQueueConfig) (*InjectQueue, error) {
+	if config.MaxDepth == 0 {
+		config.MaxDepth = INJECT_QUEUE_DEPTH
+	}
+	if config.MaxDepth < 0 {
+		return nil, fmt.Errorf("invalid max_depth %d", config.MaxDepth)
+	}
+	q := &InjectQueue{
+		config:  config,
+		buckets: make(map[string]*tokenBucket),
+		ready:   make(chan struct{}, 1),
+		depth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "solis_inject_queue_depth",
+			Help: "Number of requests waiting to be injected",
+		}),
+		waiting: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "solis_inject_queue_wait_seconds",
+			Help:    "Time requests spent in the inject queue before being sent",
+			Buckets: []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60},
+		}),
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "solis_inject_queue_dropped_total",
+				Help: "Requests dropped without being sent",
+			},
+			[]string{"source", "reason"}),
+	}
+	for source, limit := range config.RateLimits {
+		if limit.Burst == 0 {
+			limit.Burst = 1
+		}
+		if limit.Rate <= 0 || limit.Burst < 0 {
+			return nil, fmt.Errorf("rate_limits: %s: invalid rate %v, burst %d", source, limit.Rate, limit.Burst)
+		}
+		q.buckets[source] = &tokenBucket{
+			rate:   limit.Rate,
+			burst:  float64(limit.Burst),
+			tokens: float64(limit.Burst),
+			last:   time.Now(),
+		}
+	}
+	return q, nil
+}
+
+func (q *InjectQueue) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{q.depth, q.waiting, q.dropped}
+}
+
+// Add a request to the queue.  Unless an error is returned, its
+// ResponseChan will be signalled once it has been sent and answered, or
+// dropped.
+func (q *InjectQueue) Submit(i *InjectMessage) error {
+	if q.refuse != nil {
+		return q.refuse
+	}
+	now := time.Now()
+	q.lock.Lock()
+	expired := q.expire(now)
+	if len(q.queue) >= q.config.MaxDepth {
+		q.dropped.WithLabelValues(i.Source, "full").Inc()
+		q.lock.Unlock()
+		q.finish(expired)
+		return ERR_QUEUE_FULL
+	}
+	i.queued = now
+	q.queue = append(q.queue, i)
+	q.depth.Set(float64(len(q.queue)))
+	if !i.Deadline.IsZero() {
+		time.AfterFunc(i.Deadline.Sub(now)+time.Millisecond, func() {
+			q.lock.Lock()
+			expired := q.expire(time.Now())
+			q.lock.Unlock()
+			q.finish(expired)
+		})
+	}
+	q.lock.Unlock()
+	q.finish(expired)
+	q.signal()
+	return nil
+}
+
+// Take the next request to send.  If there is none, returns how long
+// until a rate-limited request could be sent (zero if the queue is empty).
+func (q *InjectQueue) Pop(now time.Time) (*InjectMessage, time.Duration) {
+	q.lock.Lock()
+	expired := q.expire(now)
+	best := -1
+	var wait time.Duration
+	for n, i := range q.queue {
+		if best >= 0 && i.Priority <= q.queue[best].Priority {
+			continue
+		}
+		if b := q.buckets[i.Source]; b != nil {
+			if w := b.wait(now); w > 0 {
+				if wait == 0 || w < wait {
+					wait = w
+				}
+				continue
+			}
+		}
+		best = n
+	}
+	var i *InjectMessage
+	if best >= 0 {
+		i = q.queue[best]
+		q.queue = append(q.queue[:best], q.queue[best+1:]...)
+		if b := q.buckets[i.Source]; b != nil {
+			b.tokens -= 1
+		}
+		q.depth.Set(float64(len(q.queue)))
+		q.waiting.Observe(now.Sub(i.queued).Seconds())
+		wait = 0
+	}
+	q.lock.Unlock()
+	q.finish(expired)
+	return i, wait
+}
+
+// Drop an expired request, which is no longer in the queue
+func (q *InjectQueue) drop(i *InjectMessage) {
+	q.dropped.WithLabelValues(i.Source, "expired").Inc()
+	if i.Modbus != nil {
+		i.Modbus.Error = ERR_EXPIRED
+	}
+	i.ResponseChan <- struct{}{}
+}
+
+// Wake up the serial port handler
+func (q *InjectQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Remove expired requests; must be called with lock held
+func (q *InjectQueue) expire(now time.Time) []*InjectMessage {
+	var expired []*InjectMessage
+	keep := q.queue[:0]
+	for _, i := range q.queue {
+		if i.expired(now) {
+			expired = append(expired, i)
+		} else {
+			keep = append(keep, i)
+		}
+	}
+	q.queue = keep
+	q.depth.Set(float64(len(q.queue)))
+	return expired
+}
+
+// Notify submitters of expired requests; must be called without lock held
+func (q *InjectQueue) finish(expired []*InjectMessage) {
+	for _, i := range expired {
+		q.drop(i)
+	}
+}
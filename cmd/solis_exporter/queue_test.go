@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func tQueue(t *testing.T, config *InjectQueueConfig) *InjectQueue {
+	q, err := NewInjectQueue(config)
+	if err != nil {
+		t.Fatalf("NewInjectQueue: %v", err)
+	}
+	return q
+}
+
+func tInjectMessage(source string, priority int) *InjectMessage {
+	return &InjectMessage{
+		Modbus:       NewReadRequest(1, 4, 33000, 1),
+		ResponseChan: make(chan struct{}, 1),
+		Source:       source,
+		Priority:     priority,
+	}
+}
+
+func TestInjectQueuePriority(t *testing.T) {
+	q := tQueue(t, &InjectQueueConfig{})
+	low := tInjectMessage("poller", PRIORITY_LOW)
+	normal1 := tInjectMessage("gateway", PRIORITY_NORMAL)
+	normal2 := tInjectMessage("gateway", PRIORITY_NORMAL)
+	high := tInjectMessage("gateway", PRIORITY_HIGH)
+	for _, i := range []*InjectMessage{low, normal1, high, normal2} {
+		if err := q.Submit(i); err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+	}
+	if v := testutil.ToFloat64(q.depth); v != 4 {
+		t.Errorf("Expected depth 4, got %v", v)
+	}
+	for n, exp := range []*InjectMessage{high, normal1, normal2, low} {
+		if i, _ := q.Pop(time.Now()); i != exp {
+			t.Errorf("Pop %d: wrong message", n)
+		}
+	}
+	if i, wait := q.Pop(time.Now()); i != nil || wait != 0 {
+		t.Errorf("Expected empty queue, got %v %v", i, wait)
+	}
+}
+
+func TestInjectQueueRateLimit(t *testing.T) {
+	q := tQueue(t, &InjectQueueConfig{
+		RateLimits: map[string]RateLimit{"gateway": {Rate: 2, Burst: 2}},
+	})
+	for n := 0; n < 3; n++ {
+		q.Submit(tInjectMessage("gateway", PRIORITY_HIGH))
+	}
+	poll := tInjectMessage("poller", PRIORITY_LOW)
+	q.Submit(poll)
+
+	now := time.Now()
+	for n := 0; n < 2; n++ {
+		if i, _ := q.Pop(now); i == nil || i.Source != "gateway" {
+			t.Fatalf("Pop %d: expected gateway message within burst", n)
+		}
+	}
+	// The third gateway request must wait, but doesn't hold up others
+	if i, _ := q.Pop(now); i != poll {
+		t.Fatalf("Expected rate-limited gateway to let poller through")
+	}
+	i, wait := q.Pop(now)
+	if i != nil || wait <= 0 || wait > 500*time.Millisecond {
+		t.Fatalf("Expected wait for rate limit, got %v %v", i, wait)
+	}
+	if i, _ := q.Pop(now.Add(wait)); i == nil || i.Source != "gateway" {
+		t.Fatalf("Expected gateway message after waiting")
+	}
+}
+
+func TestInjectQueueExpiry(t *testing.T) {
+	q := tQueue(t, &InjectQueueConfig{})
+	i := tInjectMessage("gateway", PRIORITY_NORMAL)
+	i.Deadline = time.Now().Add(50 * time.Millisecond)
+	q.Submit(i)
+	select {
+	case <-i.ResponseChan:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expired request not signalled")
+	}
+	if i.Modbus.Error != ERR_EXPIRED {
+		t.Errorf("Expected ERR_EXPIRED, got %v", i.Modbus.Error)
+	}
+	if i, _ := q.Pop(time.Now()); i != nil {
+		t.Errorf("Expired request was returned")
+	}
+	if v := testutil.ToFloat64(q.dropped.WithLabelValues("gateway", "expired")); v != 1 {
+		t.Errorf("Expected 1 expired, got %v", v)
+	}
+}
+
+func TestInjectQueueFull(t *testing.T) {
+	q := tQueue(t, &InjectQueueConfig{MaxDepth: 2})
+	q.Submit(tInjectMessage("poller", PRIORITY_LOW))
+	q.Submit(tInjectMessage("poller", PRIORITY_LOW))
+	if err := q.Submit(tInjectMessage("gateway", PRIORITY_HIGH)); err != ERR_QUEUE_FULL {
+		t.Errorf("Expected ERR_QUEUE_FULL, got %v", err)
+	}
+	if v := testutil.ToFloat64(q.dropped.WithLabelValues("gateway", "full")); v != 1 {
+		t.Errorf("Expected 1 dropped, got %v", v)
+	}
+	if _, err := NewInjectQueue(&InjectQueueConfig{RateLimits: map[string]RateLimit{"x": {}}}); err == nil {
+		t.Errorf("Invalid rate limit not detected")
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+// Record every bus exchange to disk as JSON Lines, for later analysis
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const RECORDER_STAMP_FORMAT = "20060102-150405" // suffix of rotated files
+
+type RecorderConfig struct {
+	File     string        `yaml:"file"`
+	MaxSize  int64         `yaml:"max_size"`  // bytes; rotate when exceeded (0 = no limit)
+	MaxAge   time.Duration `yaml:"max_age"`   // rotate when file is older than this (0 = no limit)
+	MaxFiles int           `yaml:"max_files"` // rotated files to keep (0 = keep all)
+	Compress bool          `yaml:"compress"`  // gzip rotated files
+	Filter   *Filter       `yaml:"filter"`    // which exchanges to record (default all)
+}
+
+type Recorder struct {
+	config *RecorderConfig
+	modbus <-chan *ModbusExchange
+	file   *rotatingFile
+}
+
+// One line of the recording
+type recorderRecord struct {
+	Time      time.Time `json:"time"`
+	Sniffed   bool      `json:"sniffed"`
+	Station   byte      `json:"station"`
+	Function  byte      `json:"function"`
+	Base      uint16    `json:"base"`
+	Count     uint16    `json:"count"`
+	Request   string    `json:"request"`            // hex, including CRC
+	Response  string    `json:"response,omitempty"` // hex, including CRC
+	Exception byte      `json:"exception"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func NewRecorder(config *RecorderConfig, modbus <-chan *ModbusExchange) (*Recorder, error) {
+	if config.File == "" {
+		return nil, fmt.Errorf("recorder requires file")
+	}
+	if config.MaxSize < 0 || config.MaxAge < 0 || config.MaxFiles < 0 {
+		return nil, fmt.Errorf("recorder limits must not be negative")
+	}
+	f := &rotatingFile{
+		config: config,
+		now:    time.Now,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		config: config,
+		modbus: modbus,
+		file:   f,
+	}
+	return r, nil
+}
+
+func newRecorderRecord(m *ModbusExchange, t time.Time) *recorderRecord {
+	rec := &recorderRecord{
+		Time:      t,
+		Sniffed:   m.Sniffed,
+		Station:   m.Station,
+		Function:  m.Function,
+		Base:      m.Base,
+		Count:     m.Count,
+		Request:   hex.EncodeToString(m.Request),
+		Response:  hex.EncodeToString(m.Response),
+		Exception: m.Exception,
+	}
+	if m.Error != nil {
+		rec.Error = m.Error.Error()
+	}
+	return rec
+}
+
+func (r *Recorder) record(m *ModbusExchange) error {
+	t := m.RequestStart
+	if t.IsZero() {
+		t = r.file.now()
+	}
+	line, err := json.Marshal(newRecorderRecord(m, t))
+	if err != nil {
+		return err
+	}
+	return r.file.Write(append(line, '\n'))
+}
+
+func (r *Recorder) Run() {
+	log.Printf("Starting recorder to %s", r.config.File)
+	for m := range r.modbus {
+		if err := r.record(m); err != nil {
+			log.Printf("Recorder: %v", err)
+		}
+	}
+	r.file.Close()
+}
+
+// A log file which is rotated by size and age.  Rotated files are
+// renamed with a timestamp suffix, and optionally compressed.
+type rotatingFile struct {
+	config *RecorderConfig
+	now    func() time.Time
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = f.now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) error {
+	if f.file == nil {
+		// a previous rotation failed
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	if f.size > 0 &&
+		((f.config.MaxSize > 0 && f.size+int64(len(p)) > f.config.MaxSize) ||
+			(f.config.MaxAge > 0 && f.now().Sub(f.opened) >= f.config.MaxAge)) {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return err
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	stamp := f.now().Format(RECORDER_STAMP_FORMAT)
+	name := fmt.Sprintf("%s.%s", f.config.File, stamp)
+	// Number after any already rotated this second, even if the earlier
+	// ones have since been pruned, so that the newest sorts last
+	same, _ := filepath.Glob(name + "*")
+	last := -1
+	for _, r := range same {
+		if _, n, ok := rotatedOrder(f.config.File, r); ok && n > last {
+			last = n
+		}
+	}
+	if last >= 0 {
+		name = fmt.Sprintf("%s-%d", name, last+1)
+	}
+	if err := os.Rename(f.config.File, name); err != nil {
+		return err
+	}
+	if f.config.Compress {
+		if err := gzipFile(name); err != nil {
+			log.Printf("Recorder: compress %s: %v", name, err)
+		}
+	}
+	f.prune()
+	return f.open()
+}
+
+// Remove the oldest rotated files beyond MaxFiles
+func (f *rotatingFile) prune() {
+	if f.config.MaxFiles == 0 {
+		return
+	}
+	names, err := filepath.Glob(f.config.File + ".*")
+	if err != nil {
+		return
+	}
+	type rotatedFile struct {
+		name  string
+		stamp string
+		n     int
+	}
+	var rotated []rotatedFile
+	for _, name := range names {
+		if stamp, n, ok := rotatedOrder(f.config.File, name); ok {
+			rotated = append(rotated, rotatedFile{name, stamp, n})
+		}
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		a, b := rotated[i], rotated[j]
+		return a.stamp < b.stamp || (a.stamp == b.stamp && a.n < b.n)
+	})
+	for len(rotated) > f.config.MaxFiles {
+		if err := os.Remove(rotated[0].name); err != nil {
+			log.Printf("Recorder: %v", err)
+		}
+		rotated = rotated[1:]
+	}
+}
+
+// The timestamp of a rotated file, which sorts in age order, and the
+// number added if several were rotated within the same second.  Returns
+// ok == false for other files which happen to share the prefix.
+func rotatedOrder(file, name string) (stamp string, n int, ok bool) {
+	s := strings.TrimSuffix(strings.TrimPrefix(name, file+"."), ".gz")
+	l := len(RECORDER_STAMP_FORMAT)
+	if len(s) < l {
+		return "", 0, false
+	}
+	if _, err := time.Parse(RECORDER_STAMP_FORMAT, s[:l]); err != nil {
+		return "", 0, false
+	}
+	if len(s) > l {
+		var err error
+		if s[l] != '-' {
+			return "", 0, false
+		}
+		if n, err = strconv.Atoi(s[l+1:]); err != nil || n < 1 {
+			return "", 0, false
+		}
+	}
+	return s[:l], n, true
+}
+
+func (f *rotatingFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// Compress a file to file.gz, removing the original
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
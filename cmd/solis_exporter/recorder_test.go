@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func tRecorder(t *testing.T, config *RecorderConfig, clock *time.Time) *Recorder {
+	r, err := NewRecorder(config, nil)
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	r.file.now = func() time.Time { return *clock }
+	r.file.opened = *clock
+	return r
+}
+
+func tReadRecords(t *testing.T, name string) []recorderRecord {
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer file.Close()
+	var recs []recorderRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec recorderRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("Invalid record: %v", err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestRecorderRecord(t *testing.T) {
+	clock := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	file := filepath.Join(t.TempDir(), "bus.jsonl")
+	r := tRecorder(t, &RecorderConfig{File: file}, &clock)
+	r.record(tPrepExchange(t, "01040BB7000183C8", "018402C2C1"))
+	m := &ModbusExchange{}
+	m.ParseRequest([]byte{0x01, 0x04, 0x80, 0xE8, 0x00, 0x01, 0x98, 0x3E})
+	m.Error = ERR_TIMEOUT
+	r.record(m)
+	r.file.Close()
+
+	recs := tReadRecords(t, file)
+	if len(recs) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(recs))
+	}
+	exp := recorderRecord{
+		Time:      clock,
+		Sniffed:   false,
+		Station:   1,
+		Function:  4,
+		Base:      2999,
+		Count:     1,
+		Request:   "01040bb7000183c8",
+		Response:  "018402c2c1",
+		Exception: 2,
+	}
+	if recs[0] != exp {
+		t.Errorf("Unexpected record: %+v", recs[0])
+	}
+	if recs[1].Error != ERR_TIMEOUT.Error() || recs[1].Response != "" || recs[1].Base != 33000 {
+		t.Errorf("Unexpected record: %+v", recs[1])
+	}
+}
+
+func TestRecorderRotate(t *testing.T) {
+	clock := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	file := filepath.Join(t.TempDir(), "bus.jsonl")
+	r := tRecorder(t, &RecorderConfig{File: file, MaxSize: 500, MaxAge: time.Hour, MaxFiles: 2, Compress: true}, &clock)
+	m := tPrepExchange(t, "010480E80001983E", "01040231056CA3")
+
+	// Each record is about 200 bytes, so the third one forces rotation by size
+	for i := 0; i < 3; i++ {
+		r.record(m)
+	}
+	// Rotation by age
+	clock = clock.Add(time.Hour)
+	r.record(m)
+	// Another two rotations, so the oldest is pruned
+	clock = clock.Add(time.Hour)
+	r.record(m)
+	clock = clock.Add(time.Hour)
+	r.record(m)
+	r.file.Close()
+
+	rotated, _ := filepath.Glob(file + ".*")
+	exp := []string{file + ".20230102-170405.gz", file + ".20230102-180405.gz"}
+	if len(rotated) != 2 || rotated[0] != exp[0] || rotated[1] != exp[1] {
+		t.Fatalf("Unexpected rotated files: %v", rotated)
+	}
+	if recs := tReadRecords(t, file); len(recs) != 1 {
+		t.Errorf("Expected 1 record in current file, got %d", len(recs))
+	}
+
+	in, err := os.Open(rotated[1])
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	var rec recorderRecord
+	if err := json.NewDecoder(zr).Decode(&rec); err != nil || rec.Base != 33000 {
+		t.Errorf("Unable to read compressed record: %v %+v", err, rec)
+	}
+}
+
+// Rotations within the same second are numbered, and pruned in order
+func TestRecorderRotateSameSecond(t *testing.T) {
+	clock := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	file := filepath.Join(t.TempDir(), "bus.jsonl")
+	// Other files sharing the prefix are left alone
+	for _, other := range []string{".bak", ".old", ".2023-01-01", ".20230102-150405-x"} {
+		if err := os.WriteFile(file+other, nil, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	r := tRecorder(t, &RecorderConfig{File: file, MaxSize: 300, MaxFiles: 2, Compress: true}, &clock)
+	m := tPrepExchange(t, "010480E80001983E", "01040231056CA3")
+
+	// Every record after the first rotates
+	for i := 0; i < 12; i++ {
+		r.record(m)
+	}
+	r.file.Close()
+
+	rotated, _ := filepath.Glob(file + ".*")
+	sort.Strings(rotated)
+	exp := []string{
+		file + ".2023-01-01",
+		file + ".20230102-150405-10.gz",
+		file + ".20230102-150405-9.gz",
+		file + ".20230102-150405-x",
+		file + ".bak",
+		file + ".old",
+	}
+	if !reflect.DeepEqual(rotated, exp) {
+		t.Errorf("Unexpected files: %v", rotated)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+// Replay of exchanges recorded with the serial "dump" option, so that
+// the exporter can be driven offline from a customer's capture
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+type ReplayConfig struct {
+	File     string `yaml:"file"`
+	Realtime bool   `yaml:"realtime"` // reproduce the original timing, otherwise as fast as possible
+}
+
+type Replay struct {
+	*publisher
+	config *ReplayConfig
+}
+
+// A single dumped frame, e.g.
+// "2023/01/02 15:04:05.123456 ->01040BB7000183C8"
+type replayFrame struct {
+	Time    time.Time // zero if line has no recognisable timestamp
+	Marker  string    // "->" sniffed request, "-<" sniffed response, "=>" / "=<" injected
+	Payload []byte
+}
+
+// Timestamp formats produced by the standard logger, with or without
+// date and microseconds
+var replayTimeLayouts = []string{
+	"2006/01/02 15:04:05.000000",
+	"2006/01/02 15:04:05",
+	"15:04:05.000000",
+	"15:04:05",
+}
+
+func NewReplay(config *ReplayConfig) (*Replay, error) {
+	if config.File == "" {
+		return nil, fmt.Errorf("replay requires file")
+	}
+	if _, err := os.Stat(config.File); err != nil {
+		return nil, err
+	}
+	r := &Replay{
+		publisher: newPublisher(),
+		config:    config,
+	}
+	return r, nil
+}
+
+// Parse one line of the log.  Lines without a frame marker, such as
+// other log messages, return ok == false.
+func parseReplayLine(line string) (f replayFrame, ok bool, err error) {
+	for _, marker := range []string{"->", "-<", "=>", "=<"} {
+		i := strings.Index(line, marker)
+		if i < 0 {
+			continue
+		}
+		f.Marker = marker
+		f.Payload, err = hex.DecodeString(strings.TrimSpace(line[i+2:]))
+		if err != nil {
+			return f, false, err
+		}
+		prefix := strings.TrimSpace(line[:i])
+		for _, layout := range replayTimeLayouts {
+			if t, err := time.Parse(layout, prefix); err == nil {
+				f.Time = t
+				break
+			}
+		}
+		return f, true, nil
+	}
+	return f, false, nil
+}
+
+// Read frames and pair requests with responses.  Each completed
+// exchange is passed to 'emit' along with the time of its request.
+func readReplay(r io.Reader, emit func(*ModbusExchange, time.Time)) error {
+	var m *ModbusExchange
+	var start time.Time
+	flush := func() {
+		if m != nil && m.Station != 0 {
+			log.Printf("Replay: no response to %02X", m.Request)
+		}
+		if m != nil && m.Station == 0 {
+			emit(m, start) // broadcast
+		}
+		m = nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		f, ok, err := parseReplayLine(scanner.Text())
+		if err != nil {
+			log.Printf("Replay: line %d: %v", lineno, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		switch f.Marker {
+		case "->", "=>":
+			flush()
+			m = &ModbusExchange{Sniffed: f.Marker == "->", RequestStart: f.Time}
+			start = f.Time
+			if rem := m.ParseRequest(f.Payload); rem != 0 || m.Error != nil {
+				log.Printf("Replay: line %d: bad request: %d: %v", lineno, rem, m.Error)
+				m = nil
+			}
+		case "-<", "=<":
+			if m == nil || m.Sniffed != (f.Marker == "-<") {
+				log.Printf("Replay: line %d: response without request", lineno)
+				continue
+			}
+			if rem := m.ParseResponse(f.Payload); rem != 0 || m.Error != nil {
+				log.Printf("Replay: line %d: bad response: %d: %v", lineno, rem, m.Error)
+			} else {
+				emit(m, start)
+			}
+			m = nil
+		}
+	}
+	flush()
+	return scanner.Err()
+}
+
+func (r *Replay) Run() {
+	log.Printf("Starting replay of %s", r.config.File)
+	file, err := os.Open(r.config.File)
+	if err != nil {
+		log.Printf("Replay: %v", err)
+		return
+	}
+	defer file.Close()
+
+	var first, begin time.Time
+	count := 0
+	err = readReplay(file, func(m *ModbusExchange, t time.Time) {
+		if r.config.Realtime && !t.IsZero() {
+			if first.IsZero() || t.Before(first) {
+				// start, or timestamps without date wrapped at midnight
+				first = t
+				begin = time.Now()
+			}
+			time.Sleep(time.Until(begin.Add(t.Sub(first))))
+		}
+		r.publishMessageWait(m)
+		count++
+	})
+	if err != nil {
+		log.Printf("Replay: %v", err)
+	}
+	log.Printf("Replay complete: %d exchanges", count)
+}
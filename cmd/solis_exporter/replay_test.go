@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testReplayLog = `2023/01/02 15:04:30.822875 ->01040BB7000183C8
+2023/01/02 15:04:30.909416 -<018402C2C1
+2023/01/02 15:04:31.000000 Some other log message
+2023/01/02 15:04:31.831907 ->010480E80001983E
+2023/01/02 15:04:31.911905 -<01040231056CA3
+2023/01/02 15:04:31.951805 ->010481E20025B9DB
+2023/01/02 15:04:32.108857 -<01044A0002095D00EA0000000000000000FFFFFE620000000000000000FFFFFE6200000121000000000000000000000121000001F90000000000000000000001F9FFAF1387000032880001BAD409A5
+2023/01/02 15:04:33.000000 ->010480E80001983E
+2023/01/02 15:04:34.000000 =>0103A8010001F5AA
+2023/01/02 15:04:34.100000 =<01030200017984
+`
+
+func TestReplayParse(t *testing.T) {
+	var ms []*ModbusExchange
+	var ts []time.Time
+	err := readReplay(strings.NewReader(testReplayLog), func(m *ModbusExchange, t time.Time) {
+		ms = append(ms, m)
+		ts = append(ts, t)
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The request at :33 has no response and is dropped
+	if len(ms) != 4 {
+		t.Fatalf("Expected 4 exchanges, got %d", len(ms))
+	}
+	if ms[0].Exception != 2 || ms[0].Base != 2999 {
+		t.Errorf("Unexpected exchange 0: %+v", ms[0])
+	}
+	if ms[1].Base != 33000 || ms[1].Count != 1 || !ms[1].Sniffed {
+		t.Errorf("Unexpected exchange 1: %+v", ms[1])
+	}
+	if ms[3].Sniffed || ms[3].Function != 3 || ms[3].Base != 43009 {
+		t.Errorf("Unexpected exchange 3: %+v", ms[3])
+	}
+	if d := ts[1].Sub(ts[0]); d != 1009032*time.Microsecond {
+		t.Errorf("Unexpected timestamp difference: %v", d)
+	}
+}
+
+func TestReplayLineFormats(t *testing.T) {
+	for _, line := range []string{
+		"->010480E80001983E",
+		"15:04:31.831907 ->010480E80001983E",
+		"2023/01/02 15:04:31 ->010480E80001983E",
+	} {
+		f, ok, err := parseReplayLine(line)
+		if !ok || err != nil || f.Marker != "->" || len(f.Payload) != 8 {
+			t.Errorf("%q: unable to parse: %v %v %+v", line, ok, err, f)
+		}
+		if strings.Contains(line, ":") && f.Time.IsZero() {
+			t.Errorf("%q: timestamp not parsed", line)
+		}
+	}
+	if _, ok, err := parseReplayLine("->01XX"); ok || err == nil {
+		t.Errorf("Invalid hex not detected")
+	}
+}
+
+func TestReplayExporter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "capture.log")
+	if err := os.WriteFile(file, []byte(testReplayLog), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	r, err := NewReplay(&ReplayConfig{File: file})
+	if err != nil {
+		t.Fatalf("NewReplay: %v", err)
+	}
+	e := tExporter(t)
+	sub := r.Subscribe("test", 1, nil)
+	go func() {
+		r.Run()
+		r.Unsubscribe(sub)
+	}()
+	n := 0
+	for m := range sub.C {
+		e.handleMessage(m)
+		n++
+	}
+	if n != 4 {
+		t.Errorf("Expected 4 exchanges, got %d", n)
+	}
+	tTestGauges(t, e, map[uint16]float64{
+		33263: -414,
+	})
+}
+
+func TestReplayRealtime(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "capture.log")
+	log := "15:04:30.000000 ->010480E80001983E\n15:04:30.050000 -<01040231056CA3\n" +
+		"15:04:30.300000 ->010480E80001983E\n15:04:30.350000 -<01040231056CA3\n"
+	if err := os.WriteFile(file, []byte(log), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	r, err := NewReplay(&ReplayConfig{File: file, Realtime: true})
+	if err != nil {
+		t.Fatalf("NewReplay: %v", err)
+	}
+	r.Subscribe("test", 5, nil)
+	start := time.Now()
+	r.Run()
+	if d := time.Since(start); d < 300*time.Millisecond || d > 2*time.Second {
+		t.Errorf("Unexpected replay duration: %v", d)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+// Policy for resending injected requests which fail, shared by everything
+// which injects through the serial port handler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	RETRY_MAX_ATTEMPTS = 3                      // including the first
+	RETRY_BACKOFF      = 500 * time.Millisecond // before the first resend, doubling each time
+)
+
+var DEFAULT_RETRYABLE = []string{"timeout", "crc_failed", "collision"}
+
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+	Retryable   []string      `yaml:"retryable"` // error labels, as in solis_serial_errors_total
+	Writes      bool          `yaml:"writes"`    // also resend writes, which may already have been acted on
+}
+
+type retryPolicy struct {
+	config    *RetryConfig
+	retryable map[error]bool
+	attempts  *prometheus.CounterVec
+	results   *prometheus.CounterVec
+}
+
+func newRetryPolicy(config *RetryConfig) (*retryPolicy, error) {
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = RETRY_MAX_ATTEMPTS
+	}
+	if config.Backoff == 0 {
+		config.Backoff = RETRY_BACKOFF
+	}
+	if config.Retryable == nil {
+		config.Retryable = DEFAULT_RETRYABLE
+	}
+	if config.MaxAttempts < 1 || config.Backoff < 0 {
+		return nil, fmt.Errorf("invalid max_attempts %d or backoff %v", config.MaxAttempts, config.Backoff)
+	}
+	r := &retryPolicy{
+		config:    config,
+		retryable: make(map[error]bool),
+		attempts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "solis_inject_attempts_total",
+				Help: "Number of times injected requests were transmitted, including resends",
+			},
+			[]string{"source"}),
+		results: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "solis_inject_results_total",
+				Help: "Final outcome of injected requests, after any resends",
+			},
+			[]string{"source", "result"}),
+	}
+Label:
+	for _, label := range config.Retryable {
+		for err, l := range modbusErrorToLabel {
+			if l == label {
+				r.retryable[err] = true
+				continue Label
+			}
+		}
+		return nil, fmt.Errorf("retryable: unknown error %q", label)
+	}
+	return r, nil
+}
+
+func (r *retryPolicy) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{r.attempts, r.results}
+}
+
+// Decide whether to resend a request which failed with i.Modbus.Error,
+// and if so, when
+func (r *retryPolicy) retry(i *InjectMessage, now time.Time) bool {
+	m := i.Modbus
+	if !r.retryable[m.Error] || i.attempts+1 >= r.config.MaxAttempts {
+		return false
+	}
+	// A write which collided before any response arrived cannot have
+	// been acted on; otherwise it might have been
+	if !isReadFunction(m.Function) && !r.config.Writes && !(m.Error == ERR_COLLISION && m.ResponseStart.IsZero()) {
+		return false
+	}
+	backoff := r.config.Backoff << i.attempts
+	if !i.Deadline.IsZero() && now.Add(backoff).After(i.Deadline) {
+		return false
+	}
+	i.attempts++
+	i.notBefore = now.Add(backoff)
+	return true
+}
+
+// Record the final outcome of a request
+func (r *retryPolicy) result(i *InjectMessage) {
+	result := "ok"
+	if m := i.Modbus; m == nil {
+		result = "invalid"
+	} else if m.Error != nil {
+		result = modbusErrorToLabel[m.Error]
+		if result == "" {
+			result = "error"
+		}
+	} else if m.Exception != 0 {
+		result = "exception"
+	}
+	r.results.WithLabelValues(i.Source, result).Inc()
+}
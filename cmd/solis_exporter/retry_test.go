@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	r, err := newRetryPolicy(&RetryConfig{Backoff: time.Second})
+	if err != nil {
+		t.Fatalf("newRetryPolicy: %v", err)
+	}
+	now := time.Now()
+
+	read := &InjectMessage{Modbus: NewReadRequest(1, 4, 33000, 1)}
+	read.Modbus.Error = ERR_TIMEOUT
+	for attempt := 1; attempt < RETRY_MAX_ATTEMPTS; attempt++ {
+		if !r.retry(read, now) {
+			t.Fatalf("Attempt %d: read not retried", attempt)
+		}
+		if exp := now.Add(time.Second << (attempt - 1)); !read.notBefore.Equal(exp) {
+			t.Errorf("Attempt %d: backoff until %v, expected %v", attempt, read.notBefore, exp)
+		}
+	}
+	if r.retry(read, now) {
+		t.Errorf("Read retried beyond max_attempts")
+	}
+
+	write := &InjectMessage{Modbus: NewReadRequest(1, 6, 43000, 1)}
+	write.Modbus.Error = ERR_TIMEOUT
+	if r.retry(write, now) {
+		t.Errorf("Write retried after timeout")
+	}
+	write.Modbus.Error = ERR_COLLISION
+	if !r.retry(write, now) {
+		t.Errorf("Write not retried after collision with no response")
+	}
+
+	late := &InjectMessage{Modbus: NewReadRequest(1, 4, 33000, 1), Deadline: now.Add(500 * time.Millisecond)}
+	late.Modbus.Error = ERR_CRC_FAILED
+	if r.retry(late, now) {
+		t.Errorf("Retried beyond deadline")
+	}
+	late.Modbus.Error = ERR_INVALID
+	late.Deadline = time.Time{}
+	if r.retry(late, now) {
+		t.Errorf("Retried non-retryable error")
+	}
+}
+
+func TestRetryConfigInvalid(t *testing.T) {
+	for i, c := range []*RetryConfig{
+		{MaxAttempts: -1},
+		{Backoff: -time.Second},
+		{Retryable: []string{"bogus"}},
+	} {
+		if _, err := newRetryPolicy(c); err == nil {
+			t.Errorf("Case %d: invalid config accepted", i)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+// Switching an RS485 transceiver between transmit and receive, for
+// adapters which don't do it automatically
+
+import (
+	"fmt"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+type RS485Config struct {
+	RTS          bool          `yaml:"rts"`            // raise RTS while transmitting
+	RTSActiveLow bool          `yaml:"rts_active_low"` // lower RTS instead
+	DelayBefore  time.Duration `yaml:"delay_before"`   // from switching to transmit until first byte
+	DelayAfter   time.Duration `yaml:"delay_after"`    // from last byte until switching back to receive
+	Kernel       bool          `yaml:"kernel"`         // leave switching to the driver (TIOCSRS485)
+}
+
+func (config *RS485Config) validate() error {
+	if config.RTS == config.Kernel {
+		return fmt.Errorf("exactly one of rts or kernel must be set")
+	}
+	if config.DelayBefore < 0 || config.DelayAfter < 0 {
+		return fmt.Errorf("invalid delay_before %v or delay_after %v", config.DelayBefore, config.DelayAfter)
+	}
+	return nil
+}
+
+// Control lines of a local serial port
+type controlPort interface {
+	Port
+	SetRTS(rts bool) error
+	Drain() error                       // wait until all written data has been transmitted
+	SetRS485(config *RS485Config) error // enable the driver's own direction switching
+}
+
+func openRS485(device string, port serial.Port, config *RS485Config) (Port, error) {
+	p, err := newTTYPort(device, port)
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+	return setupRS485(p, config)
+}
+
+func setupRS485(p controlPort, config *RS485Config) (Port, error) {
+	if config.Kernel {
+		if err := p.SetRS485(config); err != nil {
+			p.Close()
+			return nil, fmt.Errorf("TIOCSRS485: %w", err)
+		}
+		return p, nil
+	}
+	// Start out receiving
+	if err := p.SetRTS(config.RTSActiveLow); err != nil {
+		p.Close()
+		return nil, fmt.Errorf("RTS: %w", err)
+	}
+	return &rtsPort{controlPort: p, config: config}, nil
+}
+
+// A port which asserts RTS only while transmitting
+type rtsPort struct {
+	controlPort
+	config *RS485Config
+}
+
+func (p *rtsPort) Write(buf []byte) (int, error) {
+	if err := p.SetRTS(!p.config.RTSActiveLow); err != nil {
+		return 0, err
+	}
+	time.Sleep(p.config.DelayBefore)
+	n, err := p.controlPort.Write(buf)
+	// Write returns once the data is buffered; the transmitter must stay
+	// enabled until it has all gone
+	if err == nil {
+		err = p.Drain()
+	}
+	time.Sleep(p.config.DelayAfter)
+	if rerr := p.SetRTS(p.config.RTSActiveLow); err == nil {
+		err = rerr
+	}
+	return n, err
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"unsafe"
+
+	"go.bug.st/serial"
+	"golang.org/x/sys/unix"
+)
+
+// struct serial_rs485 from <linux/serial.h>
+type serialRS485 struct {
+	Flags              uint32
+	DelayRTSBeforeSend uint32 // milliseconds
+	DelayRTSAfterSend  uint32
+	Padding            [5]uint32
+}
+
+const (
+	SER_RS485_ENABLED        = 1 << 0
+	SER_RS485_RTS_ON_SEND    = 1 << 1
+	SER_RS485_RTS_AFTER_SEND = 1 << 2
+)
+
+// A serial port with a second descriptor on the same device, for the
+// ioctls which go.bug.st/serial doesn't provide
+type ttyPort struct {
+	serial.Port
+	ctl *os.File
+}
+
+func newTTYPort(device string, port serial.Port) (controlPort, error) {
+	ctl, err := os.OpenFile(device, os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &ttyPort{Port: port, ctl: ctl}, nil
+}
+
+// Equivalent of tcdrain()
+func (p *ttyPort) Drain() error {
+	return unix.IoctlSetInt(int(p.ctl.Fd()), unix.TCSBRK, 1)
+}
+
+func (p *ttyPort) SetRS485(config *RS485Config) error {
+	r := serialRS485{
+		Flags:              SER_RS485_ENABLED,
+		DelayRTSBeforeSend: uint32((config.DelayBefore + 999999) / 1000000),
+		DelayRTSAfterSend:  uint32((config.DelayAfter + 999999) / 1000000),
+	}
+	if config.RTSActiveLow {
+		r.Flags |= SER_RS485_RTS_AFTER_SEND
+	} else {
+		r.Flags |= SER_RS485_RTS_ON_SEND
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, p.ctl.Fd(), unix.TIOCSRS485, uintptr(unsafe.Pointer(&r)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (p *ttyPort) Close() error {
+	p.ctl.Close()
+	return p.Port.Close()
+}
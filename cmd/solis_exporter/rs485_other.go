@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+
+	"go.bug.st/serial"
+)
+
+func newTTYPort(device string, port serial.Port) (controlPort, error) {
+	return nil, fmt.Errorf("rs485 options are only supported on Linux")
+}
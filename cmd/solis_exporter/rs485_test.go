@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Records the order of calls, and when the line was switched
+type tControlPort struct {
+	calls   []string
+	written []byte
+	rts     []time.Time
+	rs485   *RS485Config
+}
+
+func (p *tControlPort) Read(buf []byte) (int, error)         { return 0, nil }
+func (p *tControlPort) SetReadTimeout(t time.Duration) error { return nil }
+func (p *tControlPort) Close() error {
+	p.calls = append(p.calls, "close")
+	return nil
+}
+
+func (p *tControlPort) Write(buf []byte) (int, error) {
+	p.calls = append(p.calls, "write")
+	p.written = append(p.written, buf...)
+	return len(buf), nil
+}
+
+func (p *tControlPort) SetRTS(rts bool) error {
+	if rts {
+		p.calls = append(p.calls, "rts on")
+	} else {
+		p.calls = append(p.calls, "rts off")
+	}
+	p.rts = append(p.rts, time.Now())
+	return nil
+}
+
+func (p *tControlPort) Drain() error {
+	p.calls = append(p.calls, "drain")
+	return nil
+}
+
+func (p *tControlPort) SetRS485(config *RS485Config) error {
+	p.calls = append(p.calls, "rs485")
+	p.rs485 = config
+	return nil
+}
+
+func TestRS485RTS(t *testing.T) {
+	fake := &tControlPort{}
+	config := &RS485Config{RTS: true, DelayBefore: 20 * time.Millisecond, DelayAfter: 30 * time.Millisecond}
+	port, err := setupRS485(fake, config)
+	if err != nil {
+		t.Fatalf("setupRS485: %v", err)
+	}
+	if n, err := port.Write([]byte{1, 2, 3}); n != 3 || err != nil {
+		t.Fatalf("Write: %d %v", n, err)
+	}
+	exp := []string{"rts off", "rts on", "write", "drain", "rts off"}
+	if !reflect.DeepEqual(fake.calls, exp) {
+		t.Errorf("Got calls %v, expected %v", fake.calls, exp)
+	}
+	if d := fake.rts[2].Sub(fake.rts[1]); d < config.DelayBefore+config.DelayAfter {
+		t.Errorf("RTS asserted for only %v", d)
+	}
+
+	// Inverted sense
+	fake = &tControlPort{}
+	port, _ = setupRS485(fake, &RS485Config{RTS: true, RTSActiveLow: true})
+	port.Write([]byte{1})
+	exp = []string{"rts on", "rts off", "write", "drain", "rts on"}
+	if !reflect.DeepEqual(fake.calls, exp) {
+		t.Errorf("Got calls %v, expected %v", fake.calls, exp)
+	}
+}
+
+func TestRS485Kernel(t *testing.T) {
+	fake := &tControlPort{}
+	config := &RS485Config{Kernel: true}
+	port, err := setupRS485(fake, config)
+	if err != nil {
+		t.Fatalf("setupRS485: %v", err)
+	}
+	port.Write([]byte{1})
+	exp := []string{"rs485", "write"}
+	if !reflect.DeepEqual(fake.calls, exp) || fake.rs485 != config {
+		t.Errorf("Got calls %v, expected %v", fake.calls, exp)
+	}
+}
+
+func TestRS485ConfigInvalid(t *testing.T) {
+	for i, c := range []*RS485Config{
+		{},
+		{RTS: true, Kernel: true},
+		{RTS: true, DelayBefore: -time.Millisecond},
+	} {
+		if err := c.validate(); err == nil {
+			t.Errorf("Case %d: invalid config accepted", i)
+		}
+	}
+	if _, err := NewSerial(&SerialConfig{Device: "tcp://127.0.0.1:1", RS485: &RS485Config{RTS: true}}); err == nil {
+		t.Errorf("rs485 accepted for tcp device")
+	}
+}
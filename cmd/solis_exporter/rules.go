@@ -22,14 +22,44 @@ func findUint8(s []uint8, v uint8) bool {
 }
 
 func CheckRules(m *ModbusExchange, rules []Rule) bool {
-	a1 := m.Base
-	a2 := m.Base + m.Count - 1
+	// Read/write multiple registers must be allowed for both ranges, and
+	// only where the same read (function 3) and write (function 16) would
+	// be allowed separately, so that a rule permitting it to read can't
+	// also let it write
+	if m.Function == 0x17 {
+		return checkRange(m.Station, 0x17, m.Base, m.Count, rules) &&
+			checkRange(m.Station, 0x17, m.WriteBase, m.WriteCount, rules) &&
+			checkRange(m.Station, 0x03, m.Base, m.Count, rules) &&
+			checkRange(m.Station, 0x10, m.WriteBase, m.WriteCount, rules)
+	}
+	return checkRange(m.Station, m.Function, m.Base, m.Count, rules)
+}
+
+// Is the station allowed by any rule?
+func checkStation(station byte, rules []Rule) bool {
+	for _, rule := range rules {
+		stations := rule.Stations
+		if len(stations) == 0 {
+			stations = DEFAULT_ALLOW_STATIONS
+		}
+		if findUint8(stations, station) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that some rule allows the function to access every register
+// from base to base+count-1
+func checkRange(station, function byte, base, count uint16, rules []Rule) bool {
+	a1 := base
+	a2 := base + count - 1
 	for _, rule := range rules {
 		stations := rule.Stations
 		if len(stations) == 0 {
 			stations = DEFAULT_ALLOW_STATIONS
 		}
-		if !findUint8(stations, m.Station) {
+		if !findUint8(stations, station) {
 			continue
 		}
 		lower := rule.From
@@ -44,7 +74,7 @@ func CheckRules(m *ModbusExchange, rules []Rule) bool {
 		if len(fns) == 0 {
 			fns = DEFAULT_ALLOW_FUNCTIONS
 		}
-		if !findUint8(fns, m.Function) {
+		if !findUint8(fns, function) {
 			continue
 		}
 		// All conditions matched
@@ -58,3 +58,38 @@ func TestInvalidStation(t *testing.T) {
 		t.Fatalf("Should not be allowed")
 	}
 }
+
+// Both the registers read and written by function 23 must be allowed,
+// and function 23 itself listed for them
+func TestRulesReadWrite(t *testing.T) {
+	rules := []Rule{
+		{From: 33000, To: 33999, Functions: []uint8{3, 4, 23}},
+		{From: 34000, To: 34999, Functions: []uint8{3, 23}},
+		{From: 43143, To: 43150, Functions: []uint8{3, 16, 23}},
+		{From: 43200, To: 43210, Functions: []uint8{3, 16}},
+	}
+	for i, tc := range []struct {
+		m  *ModbusExchange
+		ok bool
+	}{
+		{&ModbusExchange{Base: 33000, Count: 2, WriteBase: 43143, WriteCount: 8}, true},
+		{&ModbusExchange{Base: 43143, Count: 2, WriteBase: 43145, WriteCount: 1}, true},
+		{&ModbusExchange{Base: 32999, Count: 2, WriteBase: 43143, WriteCount: 1}, false},
+		{&ModbusExchange{Base: 33000, Count: 2, WriteBase: 43150, WriteCount: 2}, false},
+		{&ModbusExchange{Base: 33000, Count: 2, WriteBase: 1, WriteCount: 1}, false},
+		// A wide read-only rule doesn't allow writes within its range
+		{&ModbusExchange{Base: 33000, Count: 2, WriteBase: 33010, WriteCount: 1}, false},
+		{&ModbusExchange{Base: 34000, Count: 2, WriteBase: 34010, WriteCount: 1}, false},
+		{&ModbusExchange{Base: 34000, Count: 2, WriteBase: 43143, WriteCount: 1}, true},
+		// Reads and writes allowed separately don't allow function 23
+		{&ModbusExchange{Base: 43200, Count: 2, WriteBase: 43205, WriteCount: 1}, false},
+		{&ModbusExchange{Base: 43200, Count: 2, WriteBase: 43143, WriteCount: 1}, false},
+		{&ModbusExchange{Base: 33000, Count: 2, WriteBase: 43200, WriteCount: 1}, false},
+	} {
+		tc.m.Station = 1
+		tc.m.Function = 23
+		if res := CheckRules(tc.m, rules); res != tc.ok {
+			t.Errorf("Case %d: got %v, expected %v", i, res, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+// Learn the data logger's polling schedule from sniffed traffic, so that
+// injected requests can be timed to avoid its next burst.
+//
+// The Solis data logger polls in a burst every minute, plus probes about
+// 30 seconds apart (see docs/packet_log).  We group sniffed requests into
+// bursts, find the period at which bursts repeat, and predict that each
+// burst seen in the last period will recur one period later.
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	SCHEDULE_BURST_GAP  = 3 * time.Second  // requests closer than this belong to one burst
+	SCHEDULE_HISTORY    = 10 * time.Minute // how long to remember bursts
+	SCHEDULE_MIN_PERIOD = 5 * time.Second
+	SCHEDULE_MAX_PERIOD = 5 * time.Minute
+	SCHEDULE_TOLERANCE  = 2 * time.Second // jitter allowed in the period
+	SCHEDULE_MIN_MATCH  = 0.75            // fraction of bursts which must repeat at the period
+)
+
+type scheduleBurst struct {
+	start, end time.Time
+}
+
+type scheduleLearner struct {
+	bursts            []scheduleBurst // oldest first
+	period            time.Duration   // zero until learned
+	periodGauge       prometheus.Gauge
+	predictions       *prometheus.CounterVec
+	collisionsAvoided prometheus.Counter
+}
+
+func newScheduleLearner() *scheduleLearner {
+	l := &scheduleLearner{
+		periodGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "solis_schedule_period_seconds",
+			Help: "Learned period of the other master's polling bursts (0 = unknown)",
+		}),
+		predictions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "solis_schedule_predictions_total",
+				Help: "Sniffed bursts which were predicted (hit) or not (miss) by the learned schedule",
+			},
+			[]string{"result"}),
+		collisionsAvoided: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "solis_schedule_collisions_avoided_total",
+			Help: "Injections held back because a burst from the other master was predicted",
+		}),
+	}
+	for _, label := range []string{"hit", "miss"} {
+		l.predictions.WithLabelValues(label)
+	}
+	return l
+}
+
+func (l *scheduleLearner) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{l.periodGauge, l.predictions, l.collisionsAvoided}
+}
+
+// Record a sniffed exchange
+func (l *scheduleLearner) observe(start, end time.Time) {
+	if start.IsZero() {
+		start = end
+	}
+	if n := len(l.bursts); n > 0 && start.Sub(l.bursts[n-1].end) < SCHEDULE_BURST_GAP {
+		if end.After(l.bursts[n-1].end) {
+			l.bursts[n-1].end = end
+		}
+		return
+	}
+
+	// Start of a new burst: did we see it coming?
+	if l.period != 0 {
+		if l.predicted(start) {
+			l.predictions.WithLabelValues("hit").Inc()
+		} else {
+			l.predictions.WithLabelValues("miss").Inc()
+		}
+	}
+	l.bursts = append(l.bursts, scheduleBurst{start: start, end: end})
+	for len(l.bursts) > 0 && start.Sub(l.bursts[0].start) > SCHEDULE_HISTORY {
+		l.bursts = l.bursts[1:]
+	}
+	l.estimate()
+}
+
+// Whether burst b has a predecessor about d earlier
+func (l *scheduleLearner) repeats(b scheduleBurst, d time.Duration) bool {
+	for _, p := range l.bursts {
+		diff := b.start.Sub(p.start) - d
+		if diff >= -SCHEDULE_TOLERANCE && diff <= SCHEDULE_TOLERANCE {
+			return true
+		}
+	}
+	return false
+}
+
+// The period is the shortest interval at which most bursts repeat.
+// Only bursts which are late enough to have a predecessor in our history
+// are counted.
+func (l *scheduleLearner) estimate() {
+	var best time.Duration
+	for i, b := range l.bursts {
+		for _, p := range l.bursts[:i] {
+			d := b.start.Sub(p.start)
+			if d < SCHEDULE_MIN_PERIOD || d > SCHEDULE_MAX_PERIOD || (best != 0 && d >= best) {
+				continue
+			}
+			eligible, matched := 0, 0
+			for _, c := range l.bursts {
+				if c.start.Sub(l.bursts[0].start) < d-SCHEDULE_TOLERANCE {
+					continue
+				}
+				eligible++
+				if l.repeats(c, d) {
+					matched++
+				}
+			}
+			if eligible >= 2 && float64(matched) >= SCHEDULE_MIN_MATCH*float64(eligible) {
+				best = d
+			}
+		}
+	}
+	l.period = best
+	l.periodGauge.Set(best.Seconds())
+}
+
+// Predicted busy windows: each burst recurs one and two periods later
+func (l *scheduleLearner) windows(fn func(from, to time.Time) bool) {
+	if l.period == 0 {
+		return
+	}
+	for _, b := range l.bursts {
+		for k := time.Duration(1); k <= 2; k++ {
+			if !fn(b.start.Add(k*l.period-SCHEDULE_TOLERANCE), b.end.Add(k*l.period+SCHEDULE_TOLERANCE)) {
+				return
+			}
+		}
+	}
+}
+
+func (l *scheduleLearner) predicted(t time.Time) bool {
+	hit := false
+	l.windows(func(from, to time.Time) bool {
+		hit = !t.Before(from) && !t.After(to)
+		return !hit
+	})
+	return hit
+}
+
+// How long to wait from 'now' until there is a predicted clear window
+// of at least 'need'.  Zero if clear now, or the schedule is unknown.
+func (l *scheduleLearner) clearIn(now time.Time, need time.Duration) time.Duration {
+	t := now
+	for moved := true; moved; {
+		moved = false
+		l.windows(func(from, to time.Time) bool {
+			if t.Before(to) && t.Add(need).After(from) {
+				t = to
+				moved = true
+			}
+			return true
+		})
+	}
+	return t.Sub(now)
+}
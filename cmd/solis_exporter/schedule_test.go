@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Feed the learner with the data logger's schedule from docs/packet_log
+func tLoggerTraffic(l *scheduleLearner, start time.Time, minutes int) {
+	for i := 0; i < minutes; i++ {
+		cycle := start.Add(time.Duration(i) * time.Minute)
+		// burst of 12 requests over about 5 seconds
+		for j := 0; j < 12; j++ {
+			t := cycle.Add(time.Duration(j) * 420 * time.Millisecond)
+			l.observe(t, t.Add(100*time.Millisecond))
+		}
+		for _, s := range []time.Duration{19, 50} {
+			t := cycle.Add(s * time.Second)
+			l.observe(t, t.Add(100*time.Millisecond))
+		}
+	}
+}
+
+func TestScheduleLearner(t *testing.T) {
+	l := newScheduleLearner()
+	start := time.Date(2023, 1, 2, 15, 4, 30, 0, time.UTC)
+	if d := l.clearIn(start, time.Second); d != 0 {
+		t.Errorf("Unexpected delay before learning: %v", d)
+	}
+
+	tLoggerTraffic(l, start, 4)
+	if l.period != time.Minute {
+		t.Fatalf("Expected period 1m, got %v", l.period)
+	}
+	if v := testutil.ToFloat64(l.periodGauge); v != 60 {
+		t.Errorf("Unexpected period metric: %v", v)
+	}
+	if hit := testutil.ToFloat64(l.predictions.WithLabelValues("hit")); hit < 6 {
+		t.Errorf("Expected at least 6 predicted bursts, got %v", hit)
+	}
+	if miss := testutil.ToFloat64(l.predictions.WithLabelValues("miss")); miss != 0 {
+		t.Errorf("Expected no missed predictions, got %v", miss)
+	}
+
+	next := start.Add(4 * time.Minute)
+	for _, tc := range []struct {
+		now   time.Duration // relative to next burst
+		need  time.Duration
+		delay time.Duration
+	}{
+		// clear between the probes
+		{-30 * time.Second, time.Second, 0},
+		// just before the burst: wait until after the burst, plus tolerance
+		{-3 * time.Second, 2 * time.Second, 3*time.Second + 4720*time.Millisecond + SCHEDULE_TOLERANCE},
+		// after the burst, but the probe at +19s is too close
+		{16 * time.Second, 2 * time.Second, 3*time.Second + 100*time.Millisecond + SCHEDULE_TOLERANCE},
+	} {
+		if d := l.clearIn(next.Add(tc.now), tc.need); d != tc.delay {
+			t.Errorf("At %v: expected delay %v, got %v", tc.now, tc.delay, d)
+		}
+	}
+
+	// Logger changes its schedule
+	l.observe(next.Add(30*time.Second), next.Add(30*time.Second))
+	if miss := testutil.ToFloat64(l.predictions.WithLabelValues("miss")); miss != 1 {
+		t.Errorf("Expected a missed prediction, got %v", miss)
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"log"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.bug.st/serial"
 )
 
@@ -15,79 +19,353 @@ const (
 	RESPONSE_TIMEOUT       = 1000 * time.Millisecond // max time between request and response
 	POST_TRANSMIT_TIMEOUT  = 300 * time.Millisecond  // time to wait after transmit response before next transmit
 	POST_BROADCAST_TIMEOUT = 500 * time.Millisecond  // time to wait after transmitting a broadcast
+	MIN_INTER_BYTE_TIMEOUT = 20 * time.Millisecond   // allow for OS and USB adapter latency
+	INTER_BYTE_CHARS       = 48                      // max gap within a frame, in character times
+	MAX_FRAME_CHARS        = 256                     // longest RTU frame
+	RECONNECT_MIN_BACKOFF  = 1 * time.Second         // first delay before reopening a failed port
+	RECONNECT_MAX_BACKOFF  = 60 * time.Second        // longest delay between attempts to reopen
 )
 
+var ERR_NOT_CONNECTED = fmt.Errorf("Serial port not connected")
+
 type SerialConfig struct {
-	Device string `yaml:"device"`
-	Dump   bool   `yaml:"dump"`
+	Device     string            `yaml:"device"`
+	Match      *PortMatch        `yaml:"match"` // find device by USB details instead
+	Dump       bool              `yaml:"dump"`
+	BaudRate   int               `yaml:"baud_rate"`
+	Parity     string            `yaml:"parity"`
+	DataBits   int               `yaml:"data_bits"`
+	StopBits   float64           `yaml:"stop_bits"`
+	Echo       bool              `yaml:"echo"`        // adapter receives its own transmissions
+	ListenOnly bool              `yaml:"listen_only"` // never transmit
+	Framing    string            `yaml:"framing"`     // rtu or ascii
+	RS485      *RS485Config      `yaml:"rs485"`       // transmit/receive switching
+	Queue      InjectQueueConfig `yaml:"queue"`
+	Retry      RetryConfig       `yaml:"retry"`
 }
 
 type Serial struct {
-	Inject      chan *InjectMessage
-	config      *SerialConfig
-	port        serial.Port
-	subscribers []chan *ModbusExchange
-	msg         atomic.Pointer[ModbusExchange] // the message exchange currently in progress
+	*publisher
+	Queue            *InjectQueue
+	config           *SerialConfig
+	mode             *serial.Mode
+	port             Port
+	portLock         sync.Mutex                     // held by writer, and by reader when replacing port
+	portErr          error                          // fatal error seen by reader; port must be reopened
+	isConnected      atomic.Bool                    // false while port is being reopened
+	msg              atomic.Pointer[ModbusExchange] // the message exchange currently in progress
+	receiving        *ModbusExchange                // in msg while reader fills in an injected exchange
+	retry            *retryPolicy                   // resending of failed injected requests
+	charTime         time.Duration                  // time to transmit one byte of a frame
+	interByteTimeout time.Duration                  // read timeout once a frame has started
+	learner          *scheduleLearner               // data logger's polling schedule
+	detectOverlap    bool                           // bytes received while we transmit are a collision
+	device           func() (Port, error)           // opens the underlying port
+	path             string                         // device currently open
+	ports            portEnumerator                 // finds the device for config.Match
+	info             prometheus.Gauge
+	connected        prometheus.Gauge
+	reconnects       prometheus.Counter
+	resyncDiscarded  prometheus.Counter
 }
 
-type InjectMessage struct {
-	Modbus       *ModbusExchange // already-decoded request, including CRC
-	ResponseChan chan struct{}   // exchange complete; response will have been added to Modbus
+// Fill in defaults and validate the line settings, returning the
+// corresponding serial mode
+func (config *SerialConfig) Mode() (*serial.Mode, error) {
+	if config.BaudRate == 0 {
+		config.BaudRate = 9600
+	}
+	if config.Parity == "" {
+		config.Parity = "none"
+	}
+	if config.DataBits == 0 {
+		config.DataBits = 8
+	}
+	if config.StopBits == 0 {
+		config.StopBits = 1 // although modbus spec says 2 when no parity
+	}
+
+	if config.BaudRate < 0 {
+		return nil, fmt.Errorf("invalid baud_rate %d", config.BaudRate)
+	}
+	mode := &serial.Mode{
+		BaudRate: config.BaudRate,
+		DataBits: config.DataBits,
+	}
+	switch config.Parity {
+	case "none":
+		mode.Parity = serial.NoParity
+	case "even":
+		mode.Parity = serial.EvenParity
+	case "odd":
+		mode.Parity = serial.OddParity
+	case "mark":
+		mode.Parity = serial.MarkParity
+	case "space":
+		mode.Parity = serial.SpaceParity
+	default:
+		return nil, fmt.Errorf("invalid parity %q (must be none, even, odd, mark or space)", config.Parity)
+	}
+	if config.DataBits < 5 || config.DataBits > 8 {
+		return nil, fmt.Errorf("invalid data_bits %d (must be 5 to 8)", config.DataBits)
+	}
+	switch config.StopBits {
+	case 1:
+		mode.StopBits = serial.OneStopBit
+	case 1.5:
+		mode.StopBits = serial.OnePointFiveStopBits
+	case 2:
+		mode.StopBits = serial.TwoStopBits
+	default:
+		return nil, fmt.Errorf("invalid stop_bits %v (must be 1, 1.5 or 2)", config.StopBits)
+	}
+	return mode, nil
+}
+
+// Time taken to transmit one character, including start, parity and stop bits
+func (config *SerialConfig) CharTime() time.Duration {
+	bits := 1 + float64(config.DataBits) + config.StopBits
+	if config.Parity != "none" {
+		bits += 1
+	}
+	return time.Duration(bits * float64(time.Second) / float64(config.BaudRate))
 }
 
 func NewSerial(config *SerialConfig) (*Serial, error) {
-	mode := &serial.Mode{
-		BaudRate: 9600,
-		Parity:   serial.NoParity,
-		DataBits: 8,
-		StopBits: serial.OneStopBit, // although modbus spec says TwoStopBits
+	return newSerial(config, nil)
+}
+
+// As NewSerial, but with a function to open the underlying port instead
+// of the configured device
+func newSerial(config *SerialConfig, device func() (Port, error)) (*Serial, error) {
+	mode, err := config.Mode()
+	if err != nil {
+		return nil, err
 	}
-	port, err := serial.Open(config.Device, mode)
+	queue, err := NewInjectQueue(&config.Queue)
 	if err != nil {
-		return nil, fmt.Errorf("%s: device %s", config.Device, err)
+		return nil, fmt.Errorf("queue: %w", err)
+	}
+	if config.ListenOnly {
+		queue.refuse = ERR_LISTEN_ONLY
+	}
+	retry, err := newRetryPolicy(&config.Retry)
+	if err != nil {
+		return nil, fmt.Errorf("retry: %w", err)
+	}
+	if config.Framing == "" {
+		config.Framing = "rtu"
+	}
+	if err := validFraming(config.Framing); err != nil {
+		return nil, err
+	}
+	if config.Match != nil {
+		if config.Device != "" {
+			return nil, fmt.Errorf("cannot use both device and match")
+		}
+		if err := config.Match.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.RS485 != nil {
+		if err := config.RS485.validate(); err != nil {
+			return nil, fmt.Errorf("rs485: %w", err)
+		}
+		if _, ok := tcpAddress(config.Device); ok {
+			return nil, fmt.Errorf("rs485: not available for tcp:// devices")
+		}
 	}
-
 	s := &Serial{
-		Inject: make(chan *InjectMessage),
-		config: config,
-		port:   port,
+		publisher: newPublisher(),
+		Queue:     queue,
+		receiving: &ModbusExchange{},
+		retry:     retry,
+		config:    config,
+		mode:      mode,
+		charTime:  config.CharTime(),
+		learner:   newScheduleLearner(),
+		path:      config.Device,
+		ports:     serialPorts,
+		info: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "solis_serial_info",
+			Help:        "Serial port handler settings, in labels",
+			ConstLabels: prometheus.Labels{"listen_only": strconv.FormatBool(config.ListenOnly)},
+		}),
+		connected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "solis_serial_connected",
+			Help: "Whether the serial port is open (1) or being reopened after an error (0)",
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "solis_serial_reconnects_total",
+			Help: "Number of times the serial port has been reopened after an error",
+		}),
+		resyncDiscarded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "solis_serial_resync_discarded_bytes_total",
+			Help: "Bytes discarded while finding frame boundaries after an error",
+		}),
+	}
+	s.info.Set(1)
+	s.device = device
+	if s.device == nil {
+		s.device = s.openDevice
+	}
+	s.port, err = s.open()
+	if err != nil {
+		return nil, err
+	}
+	s.setConnected(true)
+	if config.Framing == "ascii" {
+		// Each byte is sent as two hex digits
+		s.charTime *= 2
+	}
+	// At 9600 baud this is about 50ms
+	s.interByteTimeout = INTER_BYTE_CHARS * s.charTime
+	if s.interByteTimeout < MIN_INTER_BYTE_TIMEOUT {
+		s.interByteTimeout = MIN_INTER_BYTE_TIMEOUT
+	}
+	if _, ok := tcpAddress(config.Device); ok {
+		if s.interByteTimeout < TCP_INTER_BYTE_TIMEOUT {
+			s.interByteTimeout = TCP_INTER_BYTE_TIMEOUT
+		}
+	} else {
+		// A TCP converter only forwards the response once it has sent
+		// the whole request, so this can only be done on a local port
+		s.detectOverlap = true
 	}
 	return s, nil
 }
 
-// Add a subscriber (WARNING: not concurrency safe, do not use while running)
-func (s *Serial) Subscribe(buflen int) <-chan *ModbusExchange {
-	c := make(chan *ModbusExchange, buflen)
-	s.subscribers = append(s.subscribers, c)
-	return c
+// Maximum time from starting to transmit a request until the whole
+// response has been received
+func (s *Serial) exchangeTimeout(m *ModbusExchange) time.Duration {
+	return RESPONSE_TIMEOUT + time.Duration(len(m.Request)+MAX_FRAME_CHARS)*s.charTime
 }
 
-func (s *Serial) publishMessage(m *ModbusExchange) {
-	// Distribute to subscribers (without blocking)
-	for _, sub := range s.subscribers {
-		select {
-		case sub <- m:
-		default:
+func (s *Serial) open() (Port, error) {
+	port, err := s.device()
+	if err != nil {
+		return nil, err
+	}
+	if s.config.Framing == "ascii" {
+		port = newASCIIPort(port)
+	}
+	if s.config.ListenOnly {
+		port = listenOnlyPort{port}
+	}
+	return port, nil
+}
+
+func (s *Serial) openDevice() (Port, error) {
+	if address, ok := tcpAddress(s.config.Device); ok {
+		port, err := openTCP(address)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", s.config.Device, err)
+		}
+		return port, nil
+	}
+	// The adapter may have been given a different name since last time
+	if s.config.Match != nil {
+		path, err := findPort(s.ports, s.config.Match)
+		if err != nil {
+			return nil, err
+		}
+		if path != s.path {
+			log.Printf("Serial: %s is %s", s.config.Match, path)
+			s.path = path
+		}
+	}
+	port, err := serial.Open(s.path, s.mode)
+	if err != nil {
+		return nil, fmt.Errorf("%s: device %s", s.path, err)
+	}
+	if s.config.RS485 != nil {
+		p, err := openRS485(s.path, port, s.config.RS485)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rs485 %s", s.path, err)
 		}
+		return p, nil
 	}
+	return port, nil
 }
 
-func (s *Serial) readRemainderOfPacket(m *ModbusExchange, buf []byte, nread int, isRequest bool) {
+func (s *Serial) setConnected(connected bool) {
+	s.isConnected.Store(connected)
+	if connected {
+		s.connected.Set(1)
+	} else {
+		s.connected.Set(0)
+	}
+}
+
+// Metrics about the state of the serial port
+func (s *Serial) Collectors() []prometheus.Collector {
+	cs := append([]prometheus.Collector{s.info, s.connected, s.reconnects, s.resyncDiscarded, s.publisher.dropped}, s.learner.Collectors()...)
+	cs = append(cs, s.retry.Collectors()...)
+	return append(cs, s.Queue.Collectors()...)
+}
+
+// Read from the port, noting any error (as opposed to timeout) as fatal
+func (s *Serial) read(buf []byte) (int, error) {
+	n, err := s.port.Read(buf)
+	if err != nil && s.portErr == nil {
+		s.portErr = err
+	}
+	return n, err
+}
+
+// Close the port after a fatal error, e.g. USB adapter unplugged, and
+// keep trying to reopen the device with exponential backoff
+func (s *Serial) reopen() {
+	log.Printf("Serial: closing %s: %v", s.path, s.portErr)
+	s.setConnected(false)
+	s.portLock.Lock()
+	s.port.Close()
+	s.portLock.Unlock()
+
+	backoff := RECONNECT_MIN_BACKOFF
+	for {
+		time.Sleep(backoff)
+		port, err := s.open()
+		if err == nil {
+			s.portLock.Lock()
+			s.port = port
+			s.portLock.Unlock()
+			s.portErr = nil
+			s.reconnects.Inc()
+			s.setConnected(true)
+			log.Printf("Serial: reopened %s", s.path)
+			return
+		}
+		log.Printf("Serial: reopen: %v", err)
+		backoff *= 2
+		if backoff > RECONNECT_MAX_BACKOFF {
+			backoff = RECONNECT_MAX_BACKOFF
+		}
+	}
+}
+
+// Returns the number of bytes in buf, which on error may be an invalid
+// or partial frame
+func (s *Serial) readRemainderOfPacket(m *ModbusExchange, buf []byte, nread int, isRequest bool) int {
 	rem := 4 // minimum packet is 5 bytes including CRC
 	for rem > 0 {
 		// s.port.Read can return partial results.
 		// It returns n == 0 for timeout.
 		for rem > 0 {
-			n, err := s.port.Read(buf[nread : nread+rem])
+			if nread+rem > len(buf) {
+				m.Error = ERR_INVALID
+				return nread
+			}
+			n, err := s.read(buf[nread : nread+rem])
 			nread += n
 			rem -= n
 			if err != nil {
 				m.Error = err
-				return
+				return nread
 			}
 			if n == 0 {
 				m.Error = ERR_TIMEOUT
-				return
+				return nread
 			}
 		}
 		// Parse what we have, see if we need more
@@ -97,115 +375,397 @@ func (s *Serial) readRemainderOfPacket(m *ModbusExchange, buf []byte, nread int,
 			rem = m.ParseResponse(buf[0:nread])
 		}
 		if m.Error != nil {
-			return
+			return nread
 		}
 	}
+	return nread
+}
+
+// Discard data until the line is clear
+func (s *Serial) discard() error {
+	dummy := make([]byte, 256)
+	s.port.SetReadTimeout(ERROR_TIMEOUT)
+	for {
+		n, err := s.read(dummy)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+}
+
+// Find frame boundaries again after an error, starting with the bytes
+// already received, and publish any exchanges found on the way.  Returns
+// as soon as a frame boundary is found, or when the line goes quiet.
+func (s *Serial) resync(buf []byte, sniffer chan<- *ModbusExchange) error {
+	f := &rtuFramer{}
+	found := f.feed(buf)
+	rbuf := make([]byte, MAX_FRAME_CHARS)
+	defer func() {
+		s.resyncDiscarded.Add(float64(f.flush()))
+	}()
+	for {
+		for _, m := range found {
+			if s.config.Dump {
+				log.Printf("->%02X", m.Request)
+				if m.Response != nil {
+					log.Printf("-<%02X", m.Response)
+				}
+			}
+			sniffer <- m
+		}
+		if f.aligned() {
+			return nil
+		}
+		timeout := s.interByteTimeout
+		if f.pending != nil && len(f.buf) == 0 {
+			timeout = RESPONSE_TIMEOUT
+		}
+		s.port.SetReadTimeout(timeout)
+		n, err := s.read(rbuf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil // line is quiet
+		}
+		found = f.feed(rbuf[:n])
+	}
 }
 
 // Serial port reader goroutine: allows use of select{} for multiplexing and timeouts
 func (s *Serial) serialReader(sniffer chan *ModbusExchange, response, busy chan<- struct{}) {
-	dummy := make([]byte, 256)
+	var leftover []byte // bytes received when an error was detected
 Error:
 	for {
-		// prevent transmit; discard data until line is clear
+		// prevent transmit until frame boundaries are known again
 		s.msg.Store(&ModbusExchange{Sniffed: true})
-		s.port.SetReadTimeout(ERROR_TIMEOUT)
-		for {
-			n, err := s.port.Read(dummy)
-			if err != nil {
+		if s.portErr != nil {
+			s.reopen()
+			leftover = nil
+			if err := s.discard(); err != nil {
 				log.Printf("!receive discard: %v", err)
-				time.Sleep(1 * time.Second)
+				continue Error
 			}
-			if n == 0 {
-				break
+		} else {
+			err := s.resync(leftover, sniffer)
+			leftover = nil
+			if err != nil {
+				log.Printf("!receive resync: %v", err)
+				continue Error
 			}
 		}
 		s.msg.Store(nil)
+		// Restart the main loop's idle timer, so that it doesn't inject
+		// while we were still discarding (e.g. after reopening the port)
+		select {
+		case busy <- struct{}{}:
+		default:
+		}
 
 		for {
 			reqbuf := make([]byte, 256)
 			// Waiting for either a sniffed request or a response
 			// to an injected command.  Wait forever for first byte.
 			s.port.SetReadTimeout(serial.NoTimeout)
-			n, err := s.port.Read(reqbuf[0:1])
+			n, err := s.read(reqbuf[0:1])
 			if n != 1 || err != nil {
 				log.Printf("!request first byte: %d: %v", n, err)
 				continue Error
 			}
+			first := time.Now()
 
 			// If this is not part of a current exchange, then it's a sniffed Request.
-			// If there is an ongoing exchange, then it's a Response to injected command.
-			isRequest := s.msg.CompareAndSwap(nil, &ModbusExchange{Sniffed: true})
-			m := s.msg.Load()
+			// If there is an ongoing exchange, then it's a Response to injected
+			// command, unless the sender gives up waiting before we claim it.
+			var m *ModbusExchange
+			isRequest := false
+			for m == nil {
+				if sniffed := (&ModbusExchange{Sniffed: true, RequestStart: first}); s.msg.CompareAndSwap(nil, sniffed) {
+					m = sniffed
+					isRequest = true
+				} else if cur := s.msg.Load(); cur != nil && s.msg.CompareAndSwap(cur, s.receiving) {
+					m = cur
+				}
+			}
 
-			if isRequest {
-				// Signal main loop that line is now busy, even though we
-				// haven't received the full exchange; but don't block
+			if !isRequest {
+				rest := s.receiveInjected(m, reqbuf, first)
+				m.ResponseEnd = time.Now()
+				if s.config.Dump && m.Response != nil {
+					log.Printf("=<%02X", m.Response)
+				}
+				// Once handed back, the sender may reset m to resend it
+				err := m.Error
+				// Notify sender that response is available before
+				// releasing the line, so that it can tell whether we
+				// claimed the exchange.  Don't block.
 				select {
-				case busy <- struct{}{}:
+				case response <- struct{}{}:
 				default:
 				}
+				s.msg.CompareAndSwap(s.receiving, nil)
+				if err != nil {
+					log.Printf("!injected response: %v", err)
+					leftover = rest
+					continue Error
+				}
+				continue
+			}
+
+			// Signal main loop that line is now busy, even though we
+			// haven't received the full exchange; but don't block
+			select {
+			case busy <- struct{}{}:
+			default:
 			}
 
 			// With go-serial-bugst, under Linux at least, Read() returns
 			// whatever data is in the buffer, or the first incoming byte
 			// (it uses VMIN=1), or 0 if nothing was received within the
 			// timeout period.  Other OSes may have a lower resolution.
-			// Although the message is ended by 3.5 character gaps (~4ms),
-			// a longer timeout is fine since we calculate exactly how
-			// many bytes we want to read.
-			s.port.SetReadTimeout(50 * time.Millisecond)
-			s.readRemainderOfPacket(m, reqbuf, 1, isRequest)
-
-			if isRequest {
-				if m.Error != nil {
-					log.Printf("!request: %v", m.Error)
+			// Although the message is ended by 3.5 character gaps (~4ms
+			// at 9600 baud), a longer timeout is fine since we calculate
+			// exactly how many bytes we want to read.
+			s.port.SetReadTimeout(s.interByteTimeout)
+			nreq := s.readRemainderOfPacket(m, reqbuf, 1, true)
+			m.RequestEnd = time.Now()
+			if m.Error != nil {
+				log.Printf("!request: %v", m.Error)
+				leftover = reqbuf[:nreq]
+				continue Error
+			}
+			if s.config.Dump {
+				log.Printf("->%02X", m.Request)
+			}
+			// Wait for response, except for broadcast
+			if m.Station != 0 {
+				respbuf := make([]byte, 256)
+				s.port.SetReadTimeout(RESPONSE_TIMEOUT)
+				n, err = s.read(respbuf[0:1])
+				if n == 0 {
+					log.Printf("!response: timeout")
 					continue Error
 				}
-				if s.config.Dump {
-					log.Printf("->%02X", m.Request)
+				if n != 1 || err != nil {
+					log.Printf("!response first byte: %d: %v", n, err)
+					continue Error
 				}
-				// Wait for response, except for broadcast
-				if m.Station != 0 {
-					respbuf := make([]byte, 256)
-					s.port.SetReadTimeout(RESPONSE_TIMEOUT)
-					n, err = s.port.Read(respbuf[0:1])
-					if n == 0 {
-						log.Printf("!response: timeout")
-						continue Error
-					}
-					if n != 1 || err != nil {
-						log.Printf("!response first byte: %d: %v", n, err)
-						continue Error
-					}
-					s.port.SetReadTimeout(50 * time.Millisecond)
-					s.readRemainderOfPacket(m, respbuf, 1, false)
-					if m.Error != nil {
-						log.Printf("!response: %v", m.Error)
-						continue Error
-					}
-					if s.config.Dump {
-						log.Printf("-<%02X", m.Response)
-					}
+				m.ResponseStart = time.Now()
+				s.port.SetReadTimeout(s.interByteTimeout)
+				nresp := s.readRemainderOfPacket(m, respbuf, 1, false)
+				m.ResponseEnd = time.Now()
+				if m.Error != nil {
+					log.Printf("!response: %v", m.Error)
+					leftover = respbuf[:nresp]
+					continue Error
 				}
-				s.msg.CompareAndSwap(m, nil)
-				sniffer <- m
-			} else {
 				if s.config.Dump {
-					log.Printf("=<%02X", m.Response)
-				}
-				s.msg.CompareAndSwap(m, nil)
-				select {
-				// Notify sender that response is available.
-				// If sender has timed out/gone away, don't block
-				case response <- struct{}{}:
-				default:
+					log.Printf("-<%02X", m.Response)
 				}
 			}
+			s.msg.CompareAndSwap(m, nil)
+			sniffer <- m
 		}
 	}
 }
 
+// Receive the response to an injected request, given the first byte
+// received since it was sent.  If the adapter echoes what we transmit,
+// check the echo first.  Returns the bytes received apart from a correct
+// echo, for resynchronisation after an error: our own request must not be
+// found there and taken for another master's.
+func (s *Serial) receiveInjected(m *ModbusExchange, buf []byte, first time.Time) []byte {
+	s.port.SetReadTimeout(s.interByteTimeout)
+	if s.config.Echo {
+		l := len(m.Request)
+		nread := 1
+		for nread < l {
+			n, err := s.read(buf[nread:l])
+			nread += n
+			if err != nil {
+				m.Error = err
+				return buf[:nread]
+			}
+			if n == 0 {
+				break
+			}
+		}
+		if !bytes.Equal(buf[:nread], m.Request) {
+			m.Error = ERR_COLLISION
+			return buf[:nread]
+		}
+		if m.Station == 0 {
+			return nil // no response to broadcast
+		}
+		s.port.SetReadTimeout(RESPONSE_TIMEOUT)
+		n, err := s.read(buf[0:1])
+		if err != nil {
+			m.Error = err
+			return nil
+		}
+		if n == 0 {
+			m.Error = ERR_TIMEOUT
+			return nil
+		}
+		first = time.Now()
+		s.port.SetReadTimeout(s.interByteTimeout)
+	} else if s.detectOverlap && first.Before(m.RequestStart.Add(time.Duration(len(m.Request)-1)*s.charTime)) {
+		// Something else was transmitting at the same time as us
+		m.Error = ERR_COLLISION
+		return buf[:1]
+	}
+	m.ResponseStart = first
+	n := s.readRemainderOfPacket(m, buf, 1, false)
+	if m.Error == ERR_RESPONSE_MISMATCH {
+		// Another device's frame in our response window
+		m.Error = ERR_COLLISION
+	}
+	return buf[:n]
+}
+
+// Transmit an injected request and wait for the response, returning
+// how long the line must then be left quiet (zero if nothing was sent).
+// Returns ok == false if the state of the line is unknown, so the busy
+// timer must be restarted, and again == true if the request failed and
+// should be sent again once the line is clear.
+func (s *Serial) transmit(i *InjectMessage, response <-chan struct{}) (quiet time.Duration, ok, again bool) {
+	m := i.Modbus
+	if m == nil || m.Error != nil {
+		log.Printf("Inject: invalid message")
+		s.finish(i)
+		return 0, true, false
+	}
+	if !s.isConnected.Load() {
+		log.Printf("Inject: %v", ERR_NOT_CONNECTED)
+		m.Error = ERR_NOT_CONNECTED
+		s.finish(i)
+		return 0, true, false
+	}
+
+	m.RequestStart = time.Now()
+	if m.Station != 0 || s.config.Echo {
+		// Mark as transmitting. At this point we hand over responsibility
+		// for updating 'm' to the serialReader goroutine, and any message
+		// it receives will be considered as the response part of 'm'.
+		ok := s.msg.CompareAndSwap(nil, m)
+		if !ok { // This should be very rare
+			log.Printf("COLLISION: inject during receive?!")
+			m.Error = ERR_COLLISION
+			return 0, false, s.failed(i)
+		}
+
+		// Flush any stale buffered response
+		select {
+		case <-response:
+		default:
+		}
+	}
+
+	// Send the request
+	s.portLock.Lock()
+	var err error
+	for p, n := 0, 0; p < len(m.Request) && err == nil; p += n {
+		n, err = s.port.Write(m.Request[p:])
+		if err == nil && n < 1 {
+			err = ERR_NOT_CONNECTED
+		}
+	}
+	s.portLock.Unlock()
+	s.retry.attempts.WithLabelValues(i.Source).Inc()
+	if err != nil {
+		log.Printf("Write: %v", err)
+		if m.Station != 0 || s.config.Echo {
+			s.reclaim(m, response)
+		}
+		m.Error = err
+		return 0, false, s.failed(i)
+	}
+	// Write may return once the data is buffered, before it is sent
+	m.RequestEnd = time.Now()
+	if sent := m.RequestStart.Add(time.Duration(len(m.Request)) * s.charTime); m.RequestEnd.Before(sent) {
+		m.RequestEnd = sent
+	}
+	if s.config.Dump {
+		log.Printf("=>%02X", m.Request)
+	}
+
+	if m.Station == 0 && !s.config.Echo {
+		s.finish(i)
+		return POST_BROADCAST_TIMEOUT, true, false
+	}
+	// Wait for response (or our echo, for a broadcast)
+	select {
+	case <-response:
+	case <-time.After(s.exchangeTimeout(m)):
+		if s.reclaim(m, response) {
+			log.Printf("Inject: response timeout")
+			m.Error = ERR_TIMEOUT
+			return 0, false, s.failed(i)
+		}
+		// The response arrived just in time
+	}
+	if m.Error != nil {
+		log.Printf("Inject: %v", m.Error)
+		return 0, false, s.failed(i)
+	}
+	s.finish(i)
+	if m.Station == 0 {
+		return POST_BROADCAST_TIMEOUT, true, false
+	}
+	s.publishMessage(m)
+	// Cannot send a follow-up message until we've waited
+	return POST_TRANSMIT_TIMEOUT, true, false
+}
+
+// Take back an exchange handed over to the reader.  Returns false if the
+// reader had already claimed it, once it has finished with it.
+func (s *Serial) reclaim(m *ModbusExchange, response <-chan struct{}) bool {
+	select {
+	case <-response:
+		return false
+	default:
+	}
+	if s.msg.CompareAndSwap(m, nil) {
+		return true
+	}
+	if s.msg.Load() == s.receiving {
+		<-response
+		return false
+	}
+	// Either released since we looked, or never claimed because the
+	// reader lost sync and took the line back
+	select {
+	case <-response:
+		return false
+	default:
+		return true
+	}
+}
+
+// The exchange failed: publish it for the error counters, then decide
+// whether to send the request again
+func (s *Serial) failed(i *InjectMessage) (again bool) {
+	m := i.Modbus
+	c := *m
+	s.publishMessage(&c)
+	// The caller owns m again, so it is safe to reset it
+	if s.retry.retry(i, time.Now()) {
+		m.reset()
+		return true
+	}
+	s.finish(i)
+	return false
+}
+
+// Tell the injector that its request is complete
+func (s *Serial) finish(i *InjectMessage) {
+	s.retry.result(i)
+	i.ResponseChan <- struct{}{}
+}
+
 func (s *Serial) Run() {
 	log.Print("Starting serial port handler")
 	sniffer := make(chan *ModbusExchange, 1)
@@ -213,8 +773,59 @@ func (s *Serial) Run() {
 	busy := make(chan struct{}, 1)
 	go s.serialReader(sniffer, response, busy)
 
-	var injector <-chan *InjectMessage // don't inject while it's nil
-	var timeout <-chan time.Time       // don't wait while it's nil
+	var injector <-chan struct{} // don't inject while it's nil
+	var timeout <-chan time.Time // don't wait while it's nil
+	var retry <-chan time.Time   // rate-limited request waiting in queue
+	var deferred *InjectMessage  // waiting for predicted clear window, or to resend
+
+	// Accept requests from the queue, including any already waiting
+	idle := func() {
+		if s.config.ListenOnly {
+			return
+		}
+		injector = s.Queue.ready
+		s.Queue.signal()
+	}
+
+	// Inject a message, unless the data logger is expected to start
+	// transmitting before the exchange could complete, in which case hold
+	// it back until after that.  Returns false if the busy timer must be
+	// restarted.
+	inject := func(i *InjectMessage) bool {
+		if i.expired(time.Now()) {
+			s.Queue.drop(i)
+			idle()
+			return true
+		}
+		if m := i.Modbus; m != nil && m.Error == nil {
+			if d := s.learner.clearIn(time.Now(), s.exchangeTimeout(m)); d > 0 {
+				//log.Printf("Idle: deferring injection by %v", d)
+				if !i.heldBack {
+					s.learner.collisionsAvoided.Inc()
+					i.heldBack = true
+				}
+				deferred = i
+				injector = nil
+				timeout = time.After(d)
+				return true
+			}
+		}
+		quiet, ok, again := s.transmit(i, response)
+		if again {
+			// Send it again once the line is clear
+			deferred = i
+			injector = nil
+			return false
+		}
+		if quiet > 0 {
+			injector = nil
+			timeout = time.After(quiet)
+		} else {
+			idle()
+		}
+		return ok
+	}
+
 Busy:
 	for {
 		injector = nil
@@ -226,72 +837,44 @@ Busy:
 				continue Busy
 			case m := <-sniffer:
 				//log.Printf("Got message")
+				s.learner.observe(m.RequestStart, time.Now())
 				s.publishMessage(m)
 				continue Busy
 			case <-timeout:
-				//log.Printf("Busy: switching to idle")
-				injector = s.Inject
 				timeout = nil
-			case i := <-injector:
-				//log.Printf("Idle: injecting message")
-				m := i.Modbus
-				if m == nil || m.Error != nil {
-					log.Printf("Inject: invalid message")
-					i.ResponseChan <- struct{}{}
+				if s.msg.Load() != nil {
+					// serialReader is still discarding or receiving, and
+					// will signal busy again when it has finished
 					continue
 				}
-
-				if m.Station != 0 {
-					// Mark as transmitting. At this point we hand over responsibility
-					// for updating 'm' to the serialReader goroutine, and any message
-					// it receives will be considered as the response part of 'm'.
-					ok := s.msg.CompareAndSwap(nil, m)
-					if !ok { // This should be very rare
-						log.Printf("COLLISION: inject during receive?!")
-						m.Error = ERR_TIMEOUT
-						i.ResponseChan <- struct{}{}
-						continue Busy
+				if deferred != nil {
+					if d := time.Until(deferred.notBefore); d > 0 {
+						timeout = time.After(d)
+						continue
 					}
-
-					// Flush any stale buffered response
-					select {
-					case <-response:
-					default:
+					i := deferred
+					deferred = nil
+					if !inject(i) {
+						continue Busy
 					}
+					continue
 				}
-
-				// Send the request
-				p := 0
-				for p < len(m.Request) {
-					n, err := s.port.Write(m.Request[p:])
-					if err != nil || n < 1 {
-						log.Printf("Write: %v", err)
+				//log.Printf("Busy: switching to idle")
+				idle()
+			case <-retry:
+				retry = nil
+				s.Queue.signal()
+			case <-injector:
+				i, wait := s.Queue.Pop(time.Now())
+				if i == nil {
+					if wait > 0 {
+						retry = time.After(wait)
 					}
-					p += n
-				}
-				if s.config.Dump {
-					log.Printf("=>%02X", m.Request)
+					continue
 				}
-
-				if m.Station != 0 {
-					// Wait for response
-					select {
-					case <-response:
-						i.ResponseChan <- struct{}{}
-						s.publishMessage(m)
-						// Cannot send a follow-up message until we've waited
-						injector = nil
-						timeout = time.After(POST_TRANSMIT_TIMEOUT)
-					case <-time.After(RESPONSE_TIMEOUT):
-						log.Printf("Inject: response timeout")
-						m.Error = ERR_TIMEOUT
-						i.ResponseChan <- struct{}{}
-						continue Busy
-					}
-				} else {
-					i.ResponseChan <- struct{}{}
-					injector = nil
-					timeout = time.After(POST_BROADCAST_TIMEOUT)
+				//log.Printf("Idle: injecting message")
+				if !inject(i) {
+					continue Busy
 				}
 			}
 		}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.bug.st/serial"
+)
+
+func TestSerialConfigDefaults(t *testing.T) {
+	c := &SerialConfig{}
+	mode, err := c.Mode()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if mode.BaudRate != 9600 || mode.Parity != serial.NoParity || mode.DataBits != 8 || mode.StopBits != serial.OneStopBit {
+		t.Errorf("Unexpected default mode: %+v", mode)
+	}
+	// 10 bits at 9600 baud
+	if ct := c.CharTime(); ct != 1041666*time.Nanosecond {
+		t.Errorf("Unexpected character time: %v", ct)
+	}
+}
+
+func TestSerialConfigCharTime(t *testing.T) {
+	c := &SerialConfig{BaudRate: 19200, Parity: "even", StopBits: 2}
+	mode, err := c.Mode()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if mode.Parity != serial.EvenParity || mode.StopBits != serial.TwoStopBits {
+		t.Errorf("Unexpected mode: %+v", mode)
+	}
+	// 12 bits at 19200 baud
+	if ct := c.CharTime(); ct != 625*time.Microsecond {
+		t.Errorf("Unexpected character time: %v", ct)
+	}
+}
+
+func TestSerialConfigInvalid(t *testing.T) {
+	for i, c := range []*SerialConfig{
+		{BaudRate: -1},
+		{Parity: "bogus"},
+		{DataBits: 9},
+		{DataBits: 4},
+		{StopBits: 3},
+	} {
+		if _, err := c.Mode(); err == nil {
+			t.Errorf("Case %d: invalid config accepted", i)
+		}
+	}
+}
+
+// The device disappears and is recreated under the same name, as happens
+// when a USB adapter is unplugged and plugged back in
+func TestSerialReconnect(t *testing.T) {
+	link := filepath.Join(t.TempDir(), "ttyUSB0")
+	master, slave := tOpenPty(t)
+	if err := os.Symlink(slave, link); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	s, err := NewSerial(&SerialConfig{Device: link})
+	if err != nil {
+		t.Fatalf("NewSerial: %v", err)
+	}
+	sub := s.Subscribe("test", 5, nil).C
+	go s.Run()
+	if v := testutil.ToFloat64(s.connected); v != 1 {
+		t.Fatalf("Expected connected, got %v", v)
+	}
+
+	master.Close()
+	os.Remove(link)
+	tWaitFor(t, 2*time.Second, func() bool { return testutil.ToFloat64(s.connected) == 0 })
+
+	master, slave = tOpenPty(t)
+	defer master.Close()
+	if err := os.Symlink(slave, link); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	tWaitFor(t, 5*time.Second, func() bool { return testutil.ToFloat64(s.connected) == 1 })
+	if v := testutil.ToFloat64(s.reconnects); v != 1 {
+		t.Errorf("Expected 1 reconnect, got %v", v)
+	}
+
+	// Line must be idle before the first exchange is accepted
+	time.Sleep(ERROR_TIMEOUT + 200*time.Millisecond)
+	master.Write([]byte{0x01, 0x04, 0x80, 0xE8, 0x00, 0x01, 0x98, 0x3E})
+	master.Write([]byte{0x01, 0x04, 0x02, 0x31, 0x05, 0x6C, 0xA3})
+	select {
+	case m := <-sub:
+		if m.Error != nil || !m.Sniffed || m.Base != 33000 {
+			t.Errorf("Unexpected exchange: %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("No exchange received after reconnect")
+	}
+}
+
+func tWaitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// An adapter which echoes what we transmit, with another device
+// transmitting over our first attempt
+func TestSerialEchoCollision(t *testing.T) {
+	master, slave := tOpenPty(t)
+	defer master.Close()
+	s, err := NewSerial(&SerialConfig{Device: slave, Echo: true})
+	if err != nil {
+		t.Fatalf("NewSerial: %v", err)
+	}
+	sub := s.Subscribe("test", 5, nil).C
+	go s.Run()
+
+	req := tHex(t, "010480E80001983E")
+	rep := tHex(t, "01040231056CA3")
+	go func() {
+		buf := make([]byte, 64)
+		for attempt := 0; ; attempt++ {
+			n, err := master.Read(buf)
+			if err != nil {
+				return
+			}
+			if attempt == 0 {
+				garbled := append([]byte(nil), buf[:n]...)
+				garbled[3] ^= 0x5A
+				master.Write(garbled)
+			} else {
+				master.Write(buf[:n])
+				master.Write(rep)
+			}
+		}
+	}()
+
+	m := &ModbusExchange{}
+	m.ParseRequest(req)
+	responseChan := make(chan struct{})
+	if err := s.Queue.Submit(&InjectMessage{Modbus: m, ResponseChan: responseChan}); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	select {
+	case <-responseChan:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("No response")
+	}
+	if m.Error != nil || !bytes.Equal(m.Response, rep) {
+		t.Errorf("Unexpected exchange after retry: %+v", m)
+	}
+	if m := <-sub; m.Error != ERR_COLLISION {
+		t.Errorf("Expected collision to be published, got %+v", m)
+	}
+	if m := <-sub; m.Error != nil || m.Base != 33000 {
+		t.Errorf("Unexpected exchange published: %+v", m)
+	}
+}
+
+// The first attempt gets no response; the read is resent after backoff
+func TestSerialRetryTimeout(t *testing.T) {
+	master, slave := tOpenPty(t)
+	defer master.Close()
+	s, err := NewSerial(&SerialConfig{Device: slave, Retry: RetryConfig{Backoff: 100 * time.Millisecond}})
+	if err != nil {
+		t.Fatalf("NewSerial: %v", err)
+	}
+	sub := s.Subscribe("test", 5, nil).C
+	go s.Run()
+
+	rep := tHex(t, "01040231056CA3")
+	go func() {
+		buf := make([]byte, 64)
+		for attempt := 0; ; attempt++ {
+			if _, err := master.Read(buf); err != nil {
+				return
+			}
+			if attempt > 0 {
+				// A pty delivers instantly; leave the time a real line would take
+				time.Sleep(20 * time.Millisecond)
+				master.Write(rep)
+			}
+		}
+	}()
+
+	m := NewReadRequest(1, 4, 33000, 1)
+	responseChan := make(chan struct{})
+	if err := s.Queue.Submit(&InjectMessage{Modbus: m, ResponseChan: responseChan, Source: "test"}); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	select {
+	case <-responseChan:
+	case <-time.After(15 * time.Second):
+		t.Fatalf("No response")
+	}
+	if m.Error != nil || !bytes.Equal(m.Response, rep) {
+		t.Errorf("Unexpected exchange after retry: %+v", m)
+	}
+	if m := <-sub; m.Error != ERR_TIMEOUT {
+		t.Errorf("Expected timeout to be published, got %+v", m)
+	}
+	if v := testutil.ToFloat64(s.retry.attempts.WithLabelValues("test")); v != 2 {
+		t.Errorf("Expected 2 attempts, got %v", v)
+	}
+	if v := testutil.ToFloat64(s.retry.results.WithLabelValues("test", "ok")); v != 1 {
+		t.Errorf("Expected 1 ok result, got %v", v)
+	}
+}
+
+// Nothing may be written, even if a request reaches the queue
+func TestSerialListenOnly(t *testing.T) {
+	master, slave := tOpenPty(t)
+	defer master.Close()
+	s, err := NewSerial(&SerialConfig{Device: slave, ListenOnly: true})
+	if err != nil {
+		t.Fatalf("NewSerial: %v", err)
+	}
+	if _, err := s.port.Write([]byte{0}); err != ERR_LISTEN_ONLY {
+		t.Errorf("Write not refused: %v", err)
+	}
+	if v := testutil.ToFloat64(s.info); v != 1 {
+		t.Errorf("Expected info 1, got %v", v)
+	}
+	if n := testutil.CollectAndCount(s.info, "solis_serial_info"); n != 1 {
+		t.Errorf("Expected 1 info series, got %d", n)
+	}
+	go s.Run()
+
+	if err := s.Queue.Submit(&InjectMessage{Modbus: NewReadRequest(1, 4, 33000, 1), ResponseChan: make(chan struct{}, 1)}); err != ERR_LISTEN_ONLY {
+		t.Errorf("Submit not refused: %v", err)
+	}
+	sent := make(chan int, 1)
+	go func() {
+		n, _ := master.Read(make([]byte, 8))
+		sent <- n
+	}()
+	select {
+	case n := <-sent:
+		if n > 0 {
+			t.Errorf("Transmitted %d bytes in listen_only mode", n)
+		}
+	case <-time.After(ERROR_TIMEOUT + BUSY_TIMEOUT):
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+// Simulated Solis inverter, acting as a modbus RTU slave on a
+// pseudo-terminal, so that the exporter and gateway can be tested
+// end-to-end without hardware.  Optionally it also simulates the data
+// logger, polling on the same schedule as the real one.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	SIM_RESPONSE_DELAY  = 80 * time.Millisecond  // inverter turnaround time
+	SIM_FRAME_TIMEOUT   = 100 * time.Millisecond // discard incomplete request after this gap
+	SIM_LOGGER_GAP      = 500 * time.Millisecond // between requests in logger's burst
+	SIM_LOGGER_INTERVAL = 1 * time.Minute
+)
+
+type SimulatorConfig struct {
+	Link           string        `yaml:"link"`      // symlink to create to the pty slave
+	Registers      string        `yaml:"registers"` // register image file
+	Station        byte          `yaml:"station"`
+	Logger         bool          `yaml:"logger"`          // also act as the data logger
+	LoggerInterval time.Duration `yaml:"logger_interval"` // default 1m
+}
+
+// Register image file: each entry gives consecutive register values
+// starting at the given address
+type registerImage struct {
+	Input   map[uint16][]uint16 `yaml:"input"`
+	Holding map[uint16][]uint16 `yaml:"holding"`
+}
+
+type Simulator struct {
+	config  *SimulatorConfig
+	master  *os.File
+	slave   *os.File
+	input   map[uint16]uint16
+	holding map[uint16]uint16
+}
+
+// A request sent by the simulated data logger
+type simPoll struct {
+	Offset   time.Duration // from start of cycle
+	Function byte
+	Base     uint16
+	Count    uint16
+}
+
+// The data logger's schedule from docs/packet_log: a burst of reads
+// every minute, plus two probes of register 33000 in between
+func loggerSchedule(interval time.Duration) []simPoll {
+	var polls []simPoll
+	for i, p := range []simPoll{
+		{Function: 4, Base: 2999, Count: 1},
+		{Function: 4, Base: 33000, Count: 1},
+		{Function: 4, Base: 33250, Count: 37},
+		{Function: 4, Base: 33000, Count: 41},
+		{Function: 4, Base: 33049, Count: 36},
+		{Function: 4, Base: 33091, Count: 5},
+		{Function: 4, Base: 33100, Count: 22},
+		{Function: 4, Base: 33126, Count: 24},
+		{Function: 4, Base: 33161, Count: 20},
+		{Function: 4, Base: 33243, Count: 4},
+		{Function: 3, Base: 43009, Count: 1},
+		{Function: 4, Base: 33250, Count: 37},
+	} {
+		p.Offset = time.Duration(i) * SIM_LOGGER_GAP
+		polls = append(polls, p)
+	}
+	for _, seconds := range []int64{19, 50} {
+		polls = append(polls, simPoll{
+			Offset:   time.Duration(int64(interval) * seconds / 60),
+			Function: 4,
+			Base:     33000,
+			Count:    1,
+		})
+	}
+	return polls
+}
+
+func loadRegisterImage(filename string) (*registerImage, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	image := &registerImage{}
+	dec := yaml.NewDecoder(file)
+	dec.KnownFields(true)
+	if err = dec.Decode(image); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return image, nil
+}
+
+func expandRegisters(blocks map[uint16][]uint16) map[uint16]uint16 {
+	regs := make(map[uint16]uint16)
+	for base, values := range blocks {
+		for i, v := range values {
+			regs[base+uint16(i)] = v
+		}
+	}
+	return regs
+}
+
+func NewSimulator(config *SimulatorConfig) (*Simulator, error) {
+	if config.Registers == "" {
+		return nil, fmt.Errorf("simulator requires registers")
+	}
+	if config.Station == 0 {
+		config.Station = 1
+	}
+	if config.LoggerInterval == 0 {
+		config.LoggerInterval = SIM_LOGGER_INTERVAL
+	}
+	if config.Logger && config.LoggerInterval < 2*time.Duration(len(loggerSchedule(0)))*SIM_LOGGER_GAP {
+		return nil, fmt.Errorf("logger_interval %v is too short", config.LoggerInterval)
+	}
+	image, err := loadRegisterImage(config.Registers)
+	if err != nil {
+		return nil, err
+	}
+
+	master, slave, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+	if config.Link != "" {
+		// Replace a stale link from a previous run, but nothing else
+		if fi, err := os.Lstat(config.Link); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			os.Remove(config.Link)
+		}
+		if err := os.Symlink(slave.Name(), config.Link); err != nil {
+			master.Close()
+			slave.Close()
+			return nil, err
+		}
+	}
+
+	sim := &Simulator{
+		config:  config,
+		master:  master,
+		slave:   slave,
+		input:   expandRegisters(image.Input),
+		holding: expandRegisters(image.Holding),
+	}
+	return sim, nil
+}
+
+// Path of the pty slave, for the exporter to open
+func (sim *Simulator) Device() string {
+	return sim.slave.Name()
+}
+
+// Build a response frame, including CRC
+func simFrame(pdu ...byte) []byte {
+	return append(pdu, ModbusCRC(pdu)...)
+}
+
+func simException(m *ModbusExchange, code byte) []byte {
+	return simFrame(m.Station, m.Function|0x80, code)
+}
+
+// Act on a request, returning the response frame (nil for no response)
+func (sim *Simulator) respond(m *ModbusExchange) []byte {
+	if m.Station != sim.config.Station && m.Station != 0 {
+		return nil
+	}
+	var regs map[uint16]uint16
+	switch m.Function {
+	case 0x03, 0x06, 0x10:
+		regs = sim.holding
+	case 0x04:
+		regs = sim.input
+	default:
+		if m.Station == 0 {
+			return nil
+		}
+		return simException(m, 1) // illegal function
+	}
+	if m.Count == 0 || m.Count > 125 {
+		return simException(m, 3) // illegal data value
+	}
+	for r := uint32(m.Base); r < uint32(m.Base)+uint32(m.Count); r++ {
+		if _, ok := regs[uint16(r)]; r > 0xffff || !ok {
+			if m.Station == 0 {
+				return nil
+			}
+			return simException(m, 2) // illegal data address
+		}
+	}
+
+	var resp []byte
+	switch m.Function {
+	case 0x03, 0x04:
+		resp = []byte{m.Station, m.Function, byte(m.Count * 2)}
+		for r := m.Base; r < m.Base+m.Count; r++ {
+			resp = binary.BigEndian.AppendUint16(resp, regs[r])
+		}
+	case 0x06, 0x10:
+		if len(m.Data) != int(m.Count)*2 {
+			return simException(m, 3)
+		}
+		for i := uint16(0); i < m.Count; i++ {
+			regs[m.Base+i] = binary.BigEndian.Uint16(m.Data[i*2:])
+		}
+		resp = append([]byte{}, m.Request[:6]...)
+	}
+	if m.Station == 0 {
+		return nil // no response to broadcast
+	}
+	return simFrame(resp...)
+}
+
+// Read requests from the pty master, passing on complete frames
+func (sim *Simulator) reader(frames chan<- []byte) {
+	buf := make([]byte, 256)
+	var frame []byte
+	for {
+		if len(frame) > 0 {
+			sim.master.SetReadDeadline(time.Now().Add(SIM_FRAME_TIMEOUT))
+		} else {
+			sim.master.SetReadDeadline(time.Time{})
+		}
+		n, err := sim.master.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Printf("Simulator: incomplete request %02X", frame)
+			frame = nil
+			continue
+		}
+		if err != nil {
+			log.Printf("Simulator: read: %v", err)
+			close(frames)
+			return
+		}
+		frame = append(frame, buf[:n]...)
+		m := &ModbusExchange{}
+		if rem := m.ParseRequest(frame); rem > 0 && m.Error == nil {
+			continue
+		}
+		if m.Error != nil {
+			log.Printf("Simulator: request %02X: %v", frame, m.Error)
+		} else {
+			frames <- frame
+		}
+		frame = nil
+	}
+}
+
+func (sim *Simulator) write(frame []byte) {
+	if _, err := sim.master.Write(frame); err != nil {
+		log.Printf("Simulator: write: %v", err)
+	}
+}
+
+// Simulate a request from the data logger, and our response to it
+func (sim *Simulator) poll(p simPoll) {
+	m := NewReadRequest(sim.config.Station, p.Function, p.Base, p.Count)
+	sim.write(m.Request)
+	time.Sleep(SIM_RESPONSE_DELAY)
+	sim.write(sim.respond(m))
+}
+
+func (sim *Simulator) Run() {
+	log.Printf("Starting simulator on %s", sim.Device())
+	frames := make(chan []byte)
+	go sim.reader(frames)
+
+	var schedule []simPoll
+	var cycle time.Time
+	var next int
+	var timer <-chan time.Time // don't poll while it's nil
+	if sim.config.Logger {
+		schedule = loggerSchedule(sim.config.LoggerInterval)
+		cycle = time.Now()
+		timer = time.After(0)
+	}
+	for {
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+			m := &ModbusExchange{}
+			m.ParseRequest(frame)
+			if resp := sim.respond(m); resp != nil {
+				time.Sleep(SIM_RESPONSE_DELAY)
+				sim.write(resp)
+			}
+		case <-timer:
+			sim.poll(schedule[next])
+			next++
+			if next == len(schedule) {
+				next = 0
+				cycle = cycle.Add(sim.config.LoggerInterval)
+			}
+			timer = time.After(time.Until(cycle.Add(schedule[next].Offset)))
+		}
+	}
+}
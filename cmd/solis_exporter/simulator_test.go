@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tSimulator(t *testing.T) *Simulator {
+	image, err := loadRegisterImage("../../simulator_registers.yml")
+	if err != nil {
+		t.Fatalf("Unable to load register image: %v", err)
+	}
+	return &Simulator{
+		config:  &SimulatorConfig{Station: 1},
+		input:   expandRegisters(image.Input),
+		holding: expandRegisters(image.Holding),
+	}
+}
+
+func TestSimulatorRespond(t *testing.T) {
+	sim := tSimulator(t)
+	for _, tc := range []struct {
+		req, rep string
+	}{
+		// from docs/packet_log
+		{"01040BB7000183C8", "018402C2C1"},
+		{"010480E80001983E", "01040231056CA3"},
+		{"010481430005E9E1", "01040A0000003500EF13880003A506"},
+		{"0103A8010001F5AA", "01030200017984"},
+		{"0110A7F800060C0016000B000D001300270018533C", "0110A7F80006E28E"},
+		// other station: no response
+		{"020480E80001", ""},
+		// function 2 is not implemented
+		{"010200000001", "018201"},
+		// count too large
+		{"010480E8007E", "018403"},
+	} {
+		req, _ := hex.DecodeString(tc.req)
+		if len(req) == 6 {
+			req = append(req, ModbusCRC(req)...)
+		}
+		exp, _ := hex.DecodeString(tc.rep)
+		if len(exp) == 3 {
+			exp = append(exp, ModbusCRC(exp)...)
+		}
+		m := &ModbusExchange{}
+		if rem := m.ParseRequest(req); rem != 0 || m.Error != nil {
+			t.Fatalf("%s: invalid request: %d %v", tc.req, rem, m.Error)
+		}
+		if rep := sim.respond(m); !bytes.Equal(rep, exp) {
+			t.Errorf("%s: got %02X, expected %02X", tc.req, rep, exp)
+		}
+	}
+	// The clock write above has taken effect
+	if sim.holding[43005] != 0x18 {
+		t.Errorf("Register not written: %04X", sim.holding[43005])
+	}
+}
+
+func TestSimulatorLogger(t *testing.T) {
+	link := filepath.Join(t.TempDir(), "ttySolis")
+	sim, err := NewSimulator(&SimulatorConfig{
+		Link:      link,
+		Registers: "../../simulator_registers.yml",
+		Logger:    true,
+	})
+	if err != nil {
+		t.Skipf("Unable to create simulator: %v", err)
+	}
+	port, err := os.Open(link)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer port.Close()
+	go sim.Run()
+
+	// First exchange of the burst is the probe of register 2999
+	exp, _ := hex.DecodeString("01040BB7000183C8018402C2C1")
+	buf := make([]byte, 0, len(exp))
+	port.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(buf) < len(exp) {
+		n, err := port.Read(buf[len(buf):cap(buf)])
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		buf = buf[:len(buf)+n]
+	}
+	if !bytes.Equal(buf, exp) {
+		t.Errorf("Got %02X, expected %02X", buf, exp)
+	}
+}
+
+// Inject requests through the serial bus handler
+func TestSimulatorSerial(t *testing.T) {
+	link := filepath.Join(t.TempDir(), "ttySolis")
+	sim, err := NewSimulator(&SimulatorConfig{
+		Link:      link,
+		Registers: "../../simulator_registers.yml",
+	})
+	if err != nil {
+		t.Skipf("Unable to create simulator: %v", err)
+	}
+	go sim.Run()
+	s, err := NewSerial(&SerialConfig{Device: link})
+	if err != nil {
+		t.Fatalf("NewSerial: %v", err)
+	}
+	go s.Run()
+
+	e := tExporter(t)
+	responseChan := make(chan struct{})
+	for _, req := range []string{"010481E20025B9DB", "01040BB7000183C8"} {
+		m := &ModbusExchange{}
+		b, _ := hex.DecodeString(req)
+		m.ParseRequest(b)
+		if err := s.Queue.Submit(&InjectMessage{Modbus: m, ResponseChan: responseChan}); err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+		<-responseChan
+		if m.Error != nil {
+			t.Fatalf("%s: %v", req, m.Error)
+		}
+		if !m.RequestStart.Before(m.RequestEnd) || m.ResponseStart.Before(m.RequestEnd) || m.ResponseEnd.Before(m.ResponseStart) {
+			t.Errorf("%s: timestamps out of order: %v %v %v %v", req, m.RequestStart, m.RequestEnd, m.ResponseStart, m.ResponseEnd)
+		}
+		e.handleMessage(m)
+		if m.Base == 2999 && m.Exception != 2 {
+			t.Errorf("Expected exception 2, got %d", m.Exception)
+		}
+	}
+	tTestGauges(t, e, map[uint16]float64{
+		33263: -414,
+	})
+}
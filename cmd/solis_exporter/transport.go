@@ -0,0 +1,92 @@
+package main
+
+// Byte-stream transports which can carry the RS485 bus traffic
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+const (
+	TCP_DIAL_TIMEOUT       = 10 * time.Second
+	TCP_KEEPALIVE          = 30 * time.Second
+	TCP_INTER_BYTE_TIMEOUT = 100 * time.Millisecond // converters may split a frame across TCP segments
+)
+
+// The subset of serial.Port used by the bus handler.  Read must return
+// 0 bytes and no error when the read timeout expires, and an error
+// only when the port has failed and should be reopened.
+type Port interface {
+	Read(p []byte) (int, error)
+	Write(p []byte) (int, error)
+	SetReadTimeout(t time.Duration) error // or serial.NoTimeout
+	Close() error
+}
+
+var ERR_LISTEN_ONLY = errors.New("Serial port is listen_only")
+
+// A port which refuses to transmit
+type listenOnlyPort struct {
+	Port
+}
+
+func (p listenOnlyPort) Write(buf []byte) (int, error) {
+	return 0, ERR_LISTEN_ONLY
+}
+
+// Device name for an RS485-to-Ethernet converter in raw TCP server mode
+func tcpAddress(device string) (string, bool) {
+	if !strings.HasPrefix(device, "tcp://") {
+		return "", false
+	}
+	return strings.TrimPrefix(device, "tcp://"), true
+}
+
+// A TCP connection to a serial server, e.g. Waveshare or USR-TCP232
+type tcpPort struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func openTCP(address string) (Port, error) {
+	d := net.Dialer{
+		Timeout:   TCP_DIAL_TIMEOUT,
+		KeepAlive: TCP_KEEPALIVE,
+	}
+	conn, err := d.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpPort{conn: conn, timeout: serial.NoTimeout}, nil
+}
+
+func (p *tcpPort) Read(buf []byte) (int, error) {
+	if p.timeout == serial.NoTimeout {
+		p.conn.SetReadDeadline(time.Time{})
+	} else {
+		p.conn.SetReadDeadline(time.Now().Add(p.timeout))
+	}
+	n, err := p.conn.Read(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, nil
+	}
+	return n, err
+}
+
+func (p *tcpPort) Write(buf []byte) (int, error) {
+	return p.conn.Write(buf)
+}
+
+func (p *tcpPort) SetReadTimeout(t time.Duration) error {
+	p.timeout = t
+	return nil
+}
+
+func (p *tcpPort) Close() error {
+	return p.conn.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSerialTCP(t *testing.T) {
+	req := []byte{0x01, 0x04, 0x80, 0xE8, 0x00, 0x01, 0x98, 0x3E}
+	rep := []byte{0x01, 0x04, 0x02, 0x31, 0x05, 0x6C, 0xA3}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	s, err := NewSerial(&SerialConfig{Device: "tcp://" + ln.Addr().String()})
+	if err != nil {
+		t.Fatalf("NewSerial: %v", err)
+	}
+	sub := s.Subscribe("test", 5, nil).C
+	go s.Run()
+	conn := <-conns
+
+	// Sniffed exchange
+	time.Sleep(ERROR_TIMEOUT + 200*time.Millisecond)
+	conn.Write(req)
+	conn.Write(rep)
+	select {
+	case m := <-sub:
+		if m.Error != nil || !m.Sniffed || m.Base != 33000 {
+			t.Errorf("Unexpected exchange: %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("No sniffed exchange received")
+	}
+
+	// Converter drops the session
+	conn.Close()
+	select {
+	case conn = <-conns:
+		defer conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No reconnection")
+	}
+	tWaitFor(t, 2*time.Second, func() bool { return testutil.ToFloat64(s.connected) == 1 })
+	if v := testutil.ToFloat64(s.reconnects); v != 1 {
+		t.Errorf("Expected 1 reconnect, got %v", v)
+	}
+
+	// Injected exchange over the new session
+	go func() {
+		buf := make([]byte, len(req))
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, _ := conn.Read(buf)
+		if bytes.Equal(buf[:n], req) {
+			conn.Write(rep)
+		}
+	}()
+	m := &ModbusExchange{}
+	m.ParseRequest(req)
+	responseChan := make(chan struct{})
+	if err := s.Queue.Submit(&InjectMessage{Modbus: m, ResponseChan: responseChan}); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	<-responseChan
+	if m.Error != nil || m.Sniffed || !bytes.Equal(m.Response, rep) {
+		t.Errorf("Unexpected injected exchange: %+v", m)
+	}
+}
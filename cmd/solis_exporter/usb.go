@@ -0,0 +1,96 @@
+package main
+
+// Finding a serial port by its USB details, since device names such as
+// /dev/ttyUSB0 depend on the order in which adapters were detected
+
+import (
+	"fmt"
+	"strings"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// Zero values match anything, but at least one must be given
+type PortMatch struct {
+	VID          string `yaml:"vid"` // in hex, e.g. 1a86
+	PID          string `yaml:"pid"`
+	SerialNumber string `yaml:"serial_number"`
+	Description  string `yaml:"description"` // part of the product description
+}
+
+// Lists the serial ports present
+type portEnumerator interface {
+	Ports() ([]*enumerator.PortDetails, error)
+}
+
+type usbEnumerator struct{}
+
+var serialPorts portEnumerator = usbEnumerator{}
+
+func (usbEnumerator) Ports() ([]*enumerator.PortDetails, error) {
+	return enumerator.GetDetailedPortsList()
+}
+
+func (match *PortMatch) validate() error {
+	if *match == (PortMatch{}) {
+		return fmt.Errorf("match requires vid, pid, serial_number or description")
+	}
+	return nil
+}
+
+func (match *PortMatch) String() string {
+	var s []string
+	if match.VID != "" {
+		s = append(s, "vid="+match.VID)
+	}
+	if match.PID != "" {
+		s = append(s, "pid="+match.PID)
+	}
+	if match.SerialNumber != "" {
+		s = append(s, fmt.Sprintf("serial_number=%q", match.SerialNumber))
+	}
+	if match.Description != "" {
+		s = append(s, fmt.Sprintf("description=%q", match.Description))
+	}
+	return strings.Join(s, " ")
+}
+
+func (match *PortMatch) Match(p *enumerator.PortDetails) bool {
+	if !p.IsUSB {
+		return false
+	}
+	if match.VID != "" && !strings.EqualFold(match.VID, p.VID) {
+		return false
+	}
+	if match.PID != "" && !strings.EqualFold(match.PID, p.PID) {
+		return false
+	}
+	if match.SerialNumber != "" && match.SerialNumber != p.SerialNumber {
+		return false
+	}
+	if match.Description != "" && !strings.Contains(strings.ToLower(p.Product), strings.ToLower(match.Description)) {
+		return false
+	}
+	return true
+}
+
+// Returns the device name of the one port which matches
+func findPort(enum portEnumerator, match *PortMatch) (string, error) {
+	ports, err := enum.Ports()
+	if err != nil {
+		return "", fmt.Errorf("listing serial ports: %w", err)
+	}
+	var found []string
+	for _, p := range ports {
+		if match.Match(p) {
+			found = append(found, p.Name)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no USB serial port matches %s", match)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%d USB serial ports match %s (%s); add serial_number to choose one", len(found), match, strings.Join(found, ", "))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.bug.st/serial/enumerator"
+)
+
+type tEnumerator struct {
+	lock  sync.Mutex
+	ports []*enumerator.PortDetails
+}
+
+func (e *tEnumerator) Ports() ([]*enumerator.PortDetails, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.ports, nil
+}
+
+func (e *tEnumerator) set(ports ...*enumerator.PortDetails) {
+	e.lock.Lock()
+	e.ports = ports
+	e.lock.Unlock()
+}
+
+// Replace the system's list of ports for the duration of a test
+func tSerialPorts(t *testing.T, ports ...*enumerator.PortDetails) *tEnumerator {
+	e := &tEnumerator{ports: ports}
+	saved := serialPorts
+	serialPorts = e
+	t.Cleanup(func() { serialPorts = saved })
+	return e
+}
+
+func TestFindPort(t *testing.T) {
+	e := &tEnumerator{ports: []*enumerator.PortDetails{
+		{Name: "/dev/ttyS0"},
+		{Name: "/dev/ttyUSB0", IsUSB: true, VID: "1A86", PID: "7523", Product: "USB Serial"},
+		{Name: "/dev/ttyUSB1", IsUSB: true, VID: "0403", PID: "6001", SerialNumber: "A10K1234", Product: "FT232R USB UART"},
+		{Name: "/dev/ttyUSB2", IsUSB: true, VID: "0403", PID: "6001", SerialNumber: "A10K5678", Product: "FT232R USB UART"},
+	}}
+	for _, c := range []struct {
+		match *PortMatch
+		exp   string
+		err   string
+	}{
+		{&PortMatch{VID: "1a86"}, "/dev/ttyUSB0", ""},
+		{&PortMatch{SerialNumber: "A10K5678"}, "/dev/ttyUSB2", ""},
+		{&PortMatch{VID: "0403", PID: "6001", SerialNumber: "A10K1234"}, "/dev/ttyUSB1", ""},
+		{&PortMatch{Description: "usb serial"}, "/dev/ttyUSB0", ""},
+		{&PortMatch{Description: "ft232r"}, "", "2 USB serial ports match"},
+		{&PortMatch{VID: "067b"}, "", "no USB serial port matches vid=067b"},
+	} {
+		got, err := findPort(e, c.match)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%v: expected error %q, got %q %v", c.match, c.err, got, err)
+			}
+		} else if got != c.exp || err != nil {
+			t.Errorf("%v: got %q %v, expected %q", c.match, got, err, c.exp)
+		}
+	}
+
+	for i, c := range []*SerialConfig{
+		{Match: &PortMatch{}},
+		{Device: "/dev/ttyUSB0", Match: &PortMatch{VID: "1a86"}},
+	} {
+		if _, err := NewSerial(c); err == nil {
+			t.Errorf("Case %d: invalid config accepted", i)
+		}
+	}
+}
+
+// After reconnection the adapter is found again under its new name
+func TestSerialMatchReopen(t *testing.T) {
+	master, slave := tOpenPty(t)
+	e := tSerialPorts(t, &enumerator.PortDetails{Name: slave, IsUSB: true, VID: "1a86", PID: "7523"})
+	s, err := NewSerial(&SerialConfig{Match: &PortMatch{VID: "1a86", PID: "7523"}})
+	if err != nil {
+		t.Fatalf("NewSerial: %v", err)
+	}
+	sub := s.Subscribe("test", 5, nil).C
+	go s.Run()
+
+	master2, slave2 := tOpenPty(t)
+	defer master2.Close()
+	master.Close()
+	e.set()
+	tWaitFor(t, 2*time.Second, func() bool { return testutil.ToFloat64(s.connected) == 0 })
+
+	e.set(&enumerator.PortDetails{Name: slave2, IsUSB: true, VID: "1A86", PID: "7523"})
+	tWaitFor(t, 5*time.Second, func() bool { return testutil.ToFloat64(s.connected) == 1 })
+
+	time.Sleep(ERROR_TIMEOUT + 200*time.Millisecond)
+	master2.Write(tHex(t, "010480E80001983E"))
+	master2.Write(tHex(t, "01040231056CA3"))
+	select {
+	case m := <-sub:
+		if m.Error != nil || m.Base != 33000 {
+			t.Errorf("Unexpected exchange: %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("No exchange received on new device")
+	}
+}